@@ -0,0 +1,166 @@
+package prometheus_backfill
+
+import (
+	"fmt"
+	io_prometheus_client "github.com/prometheus/client_model/go"
+	labels2 "github.com/prometheus/prometheus/pkg/labels"
+	"math"
+	"sort"
+	"strconv"
+)
+
+type AggregationOp string
+
+const (
+	AggregateSum   AggregationOp = "sum"
+	AggregateAvg   AggregationOp = "avg"
+	AggregateMax   AggregationOp = "max"
+	AggregateCount AggregationOp = "count"
+)
+
+// AggregationRule drops the Without labels from the series of the given Metrics (all the metrics if empty) and
+// combines the samples left with the same labels at the same timestamp by Op.
+// E.g. AggregationRule{Metrics: []string{"Mem"}, Without: []string{"ID"}, Op: AggregateSum} is like the PromQL
+// `sum without(ID) (Mem)`: only the aggregated series are written to the blocks.
+type AggregationRule struct {
+	Metrics []string
+	Without []string
+	Op      AggregationOp
+}
+
+func (r *AggregationRule) matches(metricName string) bool {
+	if len(r.Metrics) == 0 {
+		return true
+	}
+	for _, m := range r.Metrics {
+		if m == metricName {
+			return true
+		}
+	}
+	return false
+}
+
+// without returns a copy of the (sorted) labels without the rule ones. The metric name is always kept.
+func (r *AggregationRule) without(labels []labels2.Label) []labels2.Label {
+	ret := make([]labels2.Label, 0, len(labels))
+	for _, l := range labels {
+		drop := false
+		for _, w := range r.Without {
+			if l.Name == w && l.Name != labels2.MetricName {
+				drop = true
+				break
+			}
+		}
+		if !drop {
+			ret = append(ret, l)
+		}
+	}
+	return ret
+}
+
+type aggregationGroup struct {
+	rule   *AggregationRule
+	metric *io_prometheus_client.Metric // first metric of the group, used as template for the aggregated one
+	labels []labels2.Label
+	ts     int64
+	sum    float64
+	max    float64
+	count  int64
+}
+
+func (g *aggregationGroup) add(v float64) {
+	g.sum += v
+	g.max = math.Max(g.max, v)
+	g.count++
+}
+
+func (g *aggregationGroup) value() float64 {
+	switch g.rule.Op {
+	case AggregateAvg:
+		return g.sum / float64(g.count)
+	case AggregateMax:
+		return g.max
+	case AggregateCount:
+		return float64(g.count)
+	default:
+		return g.sum
+	}
+}
+
+// toStoreStruct builds the aggregated metric, keeping the type (gauge or counter) of the aggregated ones
+func (g *aggregationGroup) toStoreStruct() auxStoreStruct {
+	v := g.value()
+	ts := g.ts
+	metric := &io_prometheus_client.Metric{TimestampMs: &ts}
+	if g.metric.Counter != nil && g.rule.Op != AggregateCount {
+		metric.Counter = &io_prometheus_client.Counter{Value: &v}
+	} else {
+		metric.Gauge = &io_prometheus_client.Gauge{Value: &v}
+	}
+	return auxStoreStruct{
+		metric: metric,
+		labels: g.labels,
+	}
+}
+
+func (r *AggregationRule) validate() error {
+	switch r.Op {
+	case AggregateSum, AggregateAvg, AggregateMax, AggregateCount:
+		return nil
+	}
+	return fmt.Errorf("unknown aggregation op %s", r.Op)
+}
+
+func (bh *Handler) aggregationRule(labels []labels2.Label) *AggregationRule {
+	name := labels2.Labels(labels).Get(labels2.MetricName)
+	for _, r := range bh.aggregationRules {
+		if r.matches(name) {
+			return r
+		}
+	}
+	return nil
+}
+
+// aggregate combines the samples of a block range with the same timestamp by the rules, when its block is written: the
+// groups span all the batches. aggregate is not thread-safe! Use with the writerLock.
+// toStore is expected to be sorted by time, and so is the returned slice.
+func (bh *Handler) aggregate(toStore []auxStoreStruct) []auxStoreStruct {
+	if len(bh.aggregationRules) == 0 {
+		return toStore
+	}
+	ret := make([]auxStoreStruct, 0, len(toStore))
+	groups := make(map[string]*aggregationGroup)
+	var order []*aggregationGroup
+	for _, m := range toStore {
+		rule := bh.aggregationRule(m.labels)
+		if rule == nil {
+			ret = append(ret, m)
+			continue
+		}
+		bh.aggregatedIn.Inc()
+		labels := rule.without(m.labels)
+		ts := *m.metric.TimestampMs
+		key := strconv.FormatInt(ts, 10) + labels2.Labels(labels).String()
+		g, ok := groups[key]
+		if !ok {
+			g = &aggregationGroup{
+				rule:   rule,
+				metric: m.metric,
+				labels: labels,
+				ts:     ts,
+				max:    math.Inf(-1),
+			}
+			groups[key] = g
+			order = append(order, g)
+		}
+		g.add(sampleValue(m.metric))
+	}
+	for _, g := range order {
+		ret = append(ret, g.toStoreStruct())
+	}
+	bh.aggregatedOut.Add(int64(len(order)))
+	sort.SliceStable(ret, func(i, j int) bool {
+		return *ret[i].metric.TimestampMs < *ret[j].metric.TimestampMs
+	})
+	return ret
+}
@@ -0,0 +1,49 @@
+package prometheus_backfill
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAggregationAcrossBatches(t *testing.T) {
+	dir := t.TempDir()
+	bh, err := runTestJob(t, Options{
+		OutputDir:      dir,
+		BlockDuration:  time.Hour,
+		StoreThreshold: 2,
+		AggregationRules: []AggregationRule{
+			{Metrics: []string{"mem"}, Without: []string{"ID"}, Op: AggregateSum},
+		},
+	},
+		// The samples of the group at 1000 are in different batches of StoreThreshold rows
+		[]Sample{gauge("mem", 1000, 1, "ID", "a", "host", "h"), gauge("mem", 2000, 2, "ID", "a", "host", "h")},
+		[]Sample{gauge("mem", 3000, 3, "ID", "a", "host", "h"), gauge("mem", 4000, 4, "ID", "a", "host", "h")},
+		[]Sample{gauge("mem", 1000, 10, "ID", "b", "host", "h"), gauge("mem", 2000, 20, "ID", "b", "host", "h")},
+		[]Sample{gauge("cpu", 1000, 7, "ID", "a")},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocks := readTestBlocks(t, dir)
+	if len(blocks) != 1 {
+		t.Fatalf("%d blocks, expected 1", len(blocks))
+	}
+	series := blocks[0].series
+	if len(series) != 2 {
+		t.Errorf("series %v, expected the aggregated mem and cpu", series)
+	}
+	expected := []testSample{{1000, 11}, {2000, 22}, {3000, 3}, {4000, 4}}
+	samples := series[`{__name__="mem", host="h"}`]
+	if len(samples) != len(expected) {
+		t.Fatalf("samples %v, expected %v", samples, expected)
+	}
+	for i := range expected {
+		if samples[i] != expected[i] {
+			t.Errorf("samples %v, expected %v", samples, expected)
+			break
+		}
+	}
+	if in, out := bh.aggregatedIn.Load(), bh.aggregatedOut.Load(); in != 6 || out != 4 {
+		t.Errorf("%d/%d samples aggregated, expected 6/4", in, out)
+	}
+}
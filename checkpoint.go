@@ -0,0 +1,228 @@
+package prometheus_backfill
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/oklog/ulid"
+	"golang.org/x/sync/semaphore"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// SourceOffset is sent on the channel by a producer after the tables it read from Source up to Offset: once the
+// samples of all the tables received before it are in flushed blocks, the offset is recorded in the checkpoint and is
+// returned by ResumeOffset when the job is restarted.
+// Offsets are opaque to the handler (a row number, a byte offset, a file index...).
+type SourceOffset struct {
+	Source string
+	Offset int64
+}
+
+// ProducerTable is a table (or a SourceOffset) sent on the channel by one of several producers interleaving their tables,
+// such as the sources read by RunSources. A checkpoint is only taken when no producer has sent tables after its last
+// SourceOffset: the committed blocks then never hold tables after the recorded offsets, which would be read again
+// when resuming. The messages sent as they are come from a single producer.
+type ProducerTable struct {
+	Producer string
+	Table    interface{}
+}
+
+// checkpoint is the durable progress of a job, saved as JSON
+type checkpoint struct {
+	Offsets map[string]int64           `json:"offsets"` // Source => offset of the tables in the committed blocks
+	Pools   map[string]*poolCheckpoint `json:"pools"`   // Output directory => blocks of the job
+	Done    bool                       `json:"done"`    // The job ended without errors
+
+	path     string
+	interval time.Duration
+	last     time.Time        // Time of the last checkpoint
+	pending  map[string]int64 // Offsets received since the last checkpoint
+}
+
+type poolCheckpoint struct {
+	Committed []string `json:"committed"` // Blocks with the samples of the tables before the checkpointed offsets
+	Pending   []string `json:"pending"`   // Blocks flushed after the last checkpoint, deleted on restart
+
+	final []string // Blocks already in place, when resuming a complete job
+}
+
+// setCheckpoint reads the checkpoint at path, if it exists
+func (bh *Handler) setCheckpoint(path string, interval time.Duration) error {
+	cp := &checkpoint{
+		Offsets:  make(map[string]int64),
+		Pools:    make(map[string]*poolCheckpoint),
+		path:     path,
+		interval: interval,
+		last:     time.Now(),
+		pending:  make(map[string]int64),
+	}
+	b, err := ioutil.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return fmt.Errorf("unable to read the checkpoint %s: %w", path, err)
+	default:
+		if err := json.Unmarshal(b, cp); err != nil {
+			return fmt.Errorf("unable to parse the checkpoint %s: %w", path, err)
+		}
+		Notice3("Resuming from the checkpoint", path, "offsets:", fmt.Sprint(cp.Offsets))
+		if cp.Done {
+			Notice3("The checkpointed job is complete")
+		}
+	}
+	bh.checkpoint = cp
+	return nil
+}
+
+// ResumeOffset returns the offset of source recorded by the last checkpoint, if any
+func (bh *Handler) ResumeOffset(source string) (offset int64, ok bool) {
+	if bh.checkpoint == nil {
+		return 0, false
+	}
+	offset, ok = bh.checkpoint.Offsets[source]
+	return offset, ok
+}
+
+// pool returns the checkpoint of the blocks of outputDir
+func (cp *checkpoint) pool(outputDir string) *poolCheckpoint {
+	pc, ok := cp.Pools[outputDir]
+	if !ok {
+		pc = &poolCheckpoint{}
+		cp.Pools[outputDir] = pc
+	}
+	return pc
+}
+
+// poolOf tells whether the checkpoint has blocks of outputDir. cp can be nil
+func (cp *checkpoint) poolOf(outputDir string) (*poolCheckpoint, bool) {
+	if cp == nil {
+		return nil, false
+	}
+	pc, ok := cp.Pools[outputDir]
+	return pc, ok
+}
+
+// save writes the checkpoint atomically
+func (cp *checkpoint) save() error {
+	b, err := json.MarshalIndent(cp, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := cp.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0666); err == nil {
+		err = os.Rename(tmp, cp.path)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to save the checkpoint %s: %w", cp.path, err)
+	}
+	return nil
+}
+
+// resume deletes the blocks of outputDir flushed after the last checkpoint and returns the committed ones, which the
+// cleanup of the output directory has to keep
+func (cp *checkpoint) resume(outputDir, blocksDir string) ([]ulid.ULID, error) {
+	pc := cp.pool(outputDir)
+	for _, id := range pc.Pending {
+		Notice4("Removing block flushed after the checkpoint", id)
+		for _, dir := range []string{outputDir, filepath.Join(outputDir, stagingDirName)} {
+			if err := os.RemoveAll(filepath.Join(dir, id)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	pc.Pending = nil
+	if cp.Done {
+		pc.final = pc.Committed // The blocks are in place, there is nothing left to do with them
+		return nil, nil
+	}
+	var committed []ulid.ULID
+	for _, s := range pc.Committed {
+		id, err := ulid.ParseStrict(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid block %q in the checkpoint: %w", s, err)
+		}
+		if _, err := os.Stat(filepath.Join(blocksDir, s)); err != nil {
+			return nil, fmt.Errorf("block %s of the checkpoint: %w", s, err)
+		}
+		committed = append(committed, id)
+	}
+	return committed, nil
+}
+
+// onBlockFlushed records the block as flushed after the last checkpoint.
+// It is not thread-safe! Use with the writerLock.
+func (cp *checkpoint) onBlockFlushed(p *writerPool, id ulid.ULID) error {
+	pc := cp.pool(p.outputDir)
+	pc.Pending = append(pc.Pending, id.String())
+	return cp.save()
+}
+
+// commit records the pending offsets and the blocks flushed by the pools.
+// It is not thread-safe! Use with the writerLock.
+func (cp *checkpoint) commit(pools ...*writerPool) error {
+	for source, offset := range cp.pending {
+		cp.Offsets[source] = offset
+	}
+	cp.pending = make(map[string]int64)
+	for _, p := range pools {
+		if p == nil {
+			continue
+		}
+		pc := cp.pool(p.outputDir)
+		pc.Committed = append([]string(nil), pc.final...)
+		for _, id := range p.flushed {
+			pc.Committed = append(pc.Committed, id.String())
+		}
+		pc.Pending = nil
+	}
+	if err := cp.save(); err != nil {
+		return err
+	}
+	cp.last = time.Now()
+	return nil
+}
+
+// checkpointOffset records the offset and takes a checkpoint if the interval has elapsed and no producer has sent tables
+// after its last offset: it waits for the in-flight tables, stores all the samples and flushes the open block writers
+func (bh *Handler) checkpointOffset(sem *semaphore.Weighted, offset SourceOffset) {
+	cp := bh.checkpoint
+	if cp == nil {
+		return
+	}
+	cp.pending[offset.Source] = offset.Offset
+	if time.Since(cp.last) < cp.interval || len(bh.tablesAfterOffset) > 0 {
+		return // The next offset retries
+	}
+	_ = sem.Acquire(context.Background(), bh.maxParallelConsumes)
+	defer sem.Release(bh.maxParallelConsumes)
+	bh.checkAndStore(true)
+	bh.writerLock.Lock()
+	defer bh.writerLock.Unlock()
+	if bh.failed.Load() {
+		return // The blocks flushed after the last checkpoint can't be committed
+	}
+	for _, p := range []*writerPool{bh.writers, bh.lateWriters} {
+		if p == nil {
+			continue
+		}
+		if err := p.flushAll(); err != nil {
+			bh.fail(err)
+			return
+		}
+	}
+	if err := cp.commit(bh.writers, bh.lateWriters); err != nil {
+		bh.fail(err)
+		return
+	}
+	Notice3("Checkpoint saved", cp.path, "offsets:", fmt.Sprint(cp.Offsets))
+}
+
+// finish records the final blocks of the pools of a complete job, after the compaction. The checkpoint of a failed or
+// cancelled job is left at its last consistent point
+func (cp *checkpoint) finish(pools ...*writerPool) error {
+	cp.Done = true
+	return cp.commit(pools...)
+}
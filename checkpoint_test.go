@@ -0,0 +1,191 @@
+package prometheus_backfill
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// runCancelledJob sends the messages to a new handler with the checkpoint at path, then cancels the job
+func runCancelledJob(t *testing.T, outputDir, path string, interval time.Duration,
+	messages ...interface{}) (*Handler, error) {
+	t.Helper()
+	ch := make(chan interface{}) // Unbuffered: each message is consumed before the next one is sent
+	bh, err := New(ch, Options{OutputDir: outputDir, BlockDuration: time.Hour, CheckpointPath: path,
+		CheckpointInterval: interval})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		for _, msg := range messages {
+			ch <- msg
+		}
+		cancel()
+	}()
+	return bh, bh.RunJob(ctx)
+}
+
+func TestCancelCommitsCheckpoint(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(t.TempDir(), "checkpoint")
+	_, err := runCancelledJob(t, dir, path, time.Hour,
+		[]Sample{gauge("m", 1000, 1)}, SourceOffset{Source: "s", Offset: 1})
+	var cancelErr *CancelError
+	if !errors.As(err, &cancelErr) {
+		t.Fatalf("error %v, expected a cancellation", err)
+	}
+	if cancelErr.Progress.Offsets["s"] != 1 {
+		t.Errorf("offsets %v, expected the committed s=1", cancelErr.Progress.Offsets)
+	}
+	// The blocks hold exactly the tables before the offset: they are committed
+	bh, err := New(nil, Options{OutputDir: dir, CheckpointPath: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if offset, ok := bh.ResumeOffset("s"); !ok || offset != 1 {
+		t.Errorf("resume offset %d (%t), expected 1", offset, ok)
+	}
+	if pc := bh.checkpoint.Pools[dir]; pc == nil || len(pc.Committed) != 1 || len(pc.Pending) != 0 || bh.checkpoint.Done {
+		t.Errorf("checkpoint %+v of the pool %+v, expected a committed block", bh.checkpoint, pc)
+	}
+}
+
+func TestCancelAfterTablesKeepsCheckpoint(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(t.TempDir(), "checkpoint")
+	_, err := runCancelledJob(t, dir, path, time.Hour,
+		[]Sample{gauge("m", 1000, 1)}, SourceOffset{Source: "s", Offset: 1}, []Sample{gauge("m", 2000, 2)})
+	var cancelErr *CancelError
+	if !errors.As(err, &cancelErr) {
+		t.Fatalf("error %v, expected a cancellation", err)
+	}
+	if len(cancelErr.Progress.Offsets) != 0 {
+		t.Errorf("offsets %v, expected none committed", cancelErr.Progress.Offsets)
+	}
+	bh, err := New(nil, Options{OutputDir: dir, CheckpointPath: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if offset, ok := bh.ResumeOffset("s"); ok {
+		t.Errorf("resume offset %d, expected none", offset)
+	}
+	if pc := bh.checkpoint.Pools[dir]; pc == nil || len(pc.Committed) != 0 || len(pc.Pending) != 1 {
+		t.Errorf("checkpoint of the pool %+v, expected a pending block", pc)
+	}
+}
+
+func TestCheckpointKillAndResume(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(t.TempDir(), "checkpoint")
+	hour := int64(time.Hour / time.Millisecond)
+	first, second := []Sample{gauge("m", 0, 1)}, []Sample{gauge("m", hour, 2)}
+
+	// The job is interrupted after a checkpoint of the first table: the block of the second one is pending
+	_, err := runCancelledJob(t, dir, path, 0, first, SourceOffset{Source: "s", Offset: 1}, second)
+	if !errors.As(err, new(*CancelError)) {
+		t.Fatalf("error %v, expected a cancellation", err)
+	}
+	blocks := readTestBlocks(t, dir)
+	if len(blocks) != 2 {
+		t.Fatalf("%d blocks before resuming, expected 2", len(blocks))
+	}
+	committed, pending := blocks[0].meta.ULID, blocks[1].meta.ULID
+
+	// The resumed job deletes the pending block, keeps the committed one and writes the tables after the offset
+	resume := func(t *testing.T, tables ...interface{}) *Handler {
+		ch := make(chan interface{})
+		bh, err := New(ch, Options{OutputDir: dir, BlockDuration: time.Hour, CheckpointPath: path})
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			for _, table := range tables {
+				ch <- table
+			}
+			close(ch)
+		}()
+		if err := bh.RunJob(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		return bh
+	}
+	bh := resume(t, second, SourceOffset{Source: "s", Offset: 2})
+	if offset, ok := bh.ResumeOffset("s"); !ok || offset != 2 {
+		t.Errorf("offset %d (%t) after the job, expected 2", offset, ok)
+	}
+	if !bh.checkpoint.Done {
+		t.Error("the checkpoint of the complete job is not done")
+	}
+	blocks = readTestBlocks(t, dir)
+	if len(blocks) != 2 || blocks[0].meta.ULID != committed || blocks[1].meta.ULID == pending {
+		t.Fatalf("blocks %v, expected the committed %s and a new one", blocks, committed)
+	}
+	checkNoOverlaps(t, blocks)
+	if samples := blocks[1].series[`{__name__="m"}`]; len(samples) != 1 || samples[0] != (testSample{hour, 2}) {
+		t.Errorf("samples of the second block %v", samples)
+	}
+
+	// A job resumed from a done checkpoint keeps all the blocks
+	resume(t)
+	if again := readTestBlocks(t, dir); len(again) != 2 || again[0].meta.ULID != blocks[0].meta.ULID ||
+		again[1].meta.ULID != blocks[1].meta.ULID {
+		t.Errorf("blocks %v after the job resumed from a done checkpoint, expected %v", again, blocks)
+	}
+}
+
+func TestCheckpointInterleavedProducers(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(t.TempDir(), "checkpoint")
+	hour := int64(time.Hour / time.Millisecond)
+	from := func(producer string, table interface{}) ProducerTable {
+		return ProducerTable{Producer: producer, Table: table}
+	}
+	// a has a table after its offset when b sends its own: neither that checkpoint nor the last one are taken
+	_, err := runCancelledJob(t, dir, path, 0,
+		from("a", []Sample{gauge("m", 0, 1)}),
+		from("a", SourceOffset{Source: "a", Offset: 1}),
+		from("a", []Sample{gauge("m", hour, 2)}),
+		from("b", SourceOffset{Source: "b", Offset: 1}),
+	)
+	var cancelErr *CancelError
+	if !errors.As(err, &cancelErr) {
+		t.Fatalf("error %v, expected a cancellation", err)
+	}
+	if offsets := cancelErr.Progress.Offsets; len(offsets) != 1 || offsets["a"] != 1 {
+		t.Errorf("offsets %v, expected the committed a=1", offsets)
+	}
+
+	// a resumes from its offset: the table after it is written once
+	ch := make(chan interface{})
+	bh, err := New(ch, Options{OutputDir: dir, BlockDuration: time.Hour, CheckpointPath: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if offset, ok := bh.ResumeOffset("a"); !ok || offset != 1 {
+		t.Fatalf("resume offset of a %d (%t), expected 1", offset, ok)
+	}
+	if offset, ok := bh.ResumeOffset("b"); ok {
+		t.Fatalf("resume offset of b %d, expected none", offset)
+	}
+	go func() {
+		ch <- from("a", []Sample{gauge("m", hour, 2)})
+		ch <- from("a", SourceOffset{Source: "a", Offset: 2})
+		ch <- from("b", SourceOffset{Source: "b", Offset: 1})
+		close(ch)
+	}()
+	if err := bh.RunJob(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	blocks := readTestBlocks(t, dir)
+	checkNoOverlaps(t, blocks)
+	var samples []testSample
+	for _, b := range blocks {
+		samples = append(samples, b.series[`{__name__="m"}`]...)
+	}
+	if expected := []testSample{{0, 1}, {hour, 2}}; !equalTestSamples(samples, expected) {
+		t.Errorf("samples %v, expected %v", samples, expected)
+	}
+}
@@ -0,0 +1,34 @@
+// Command backfill-overlaps reports whether the blocks produced by a backfill job overlap the blocks or the head of a
+// Prometheus data directory, the gaps between them and the blocks beyond the retention.
+//
+//	backfill-overlaps -output ./output -data /prometheus -retention 360h
+//
+// It exits with status 1 if the output blocks can't be safely moved into the data directory, 2 if the directories
+// can't be read.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/aleskandro/go-prometheus-backfiller"
+	"os"
+	"time"
+)
+
+func main() {
+	outputDir := flag.String("output", "./output", "output directory of the backfill job")
+	dataDir := flag.String("data", "./data", "Prometheus data directory")
+	retention := flag.Duration("retention", 15*24*time.Hour, "Prometheus retention time (0 to skip the check)")
+	flag.Parse()
+
+	report, err := prometheus_backfill.CheckOverlaps(*outputDir, *dataDir, *retention)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "unable to check the blocks:", err)
+		os.Exit(2)
+	}
+	report.Print(os.Stdout)
+	if !report.OK() {
+		os.Exit(1)
+	}
+	prometheus_backfill.Notice("No overlaps found")
+}
@@ -0,0 +1,134 @@
+package prometheus_backfill
+
+import (
+	"fmt"
+	"github.com/go-kit/kit/log"
+	"github.com/oklog/ulid"
+	"github.com/prometheus/prometheus/pkg/timestamp"
+	"github.com/prometheus/prometheus/tsdb"
+	"github.com/prometheus/prometheus/tsdb/chunkenc"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// compact merges the blocks flushed by the pool in its directory
+func (bh *Handler) compact(p *writerPool) {
+	if bh.compactionRange <= 0 || len(p.flushed) < 2 {
+		return
+	}
+	compactor, err := tsdb.NewLeveledCompactor(bh.ctx, nil, log.NewNopLogger(), []int64{bh.compactionRange},
+		chunkenc.NewPool())
+	if err != nil {
+		bh.reportError(&CompactionError{Dir: bh.blocksDir(p), Blocks: p.flushed, Err: err})
+		return
+	}
+	var flushed []ulid.ULID // Blocks left after the compaction
+	groups := make(map[int64][]tsdb.BlockMeta)
+	for _, id := range p.flushed {
+		meta, err := readBlockMeta(filepath.Join(bh.blocksDir(p), id.String()))
+		if err != nil {
+			bh.reportError(&CompactionError{Dir: bh.blocksDir(p), Blocks: []ulid.ULID{id}, Err: err})
+			flushed = append(flushed, id)
+			continue
+		}
+		start := alignedStart(meta.MinTime, bh.compactionRange)
+		if meta.MaxTime > start+bh.compactionRange {
+			flushed = append(flushed, id) // The block is bigger than the target range
+			continue
+		}
+		groups[start] = append(groups[start], meta)
+	}
+	for start, metas := range groups {
+		if len(metas) < 2 {
+			flushed = append(flushed, metas[0].ULID)
+			continue
+		}
+		Notice3("Compacting", len(metas), "blocks of the range", timestamp.Time(start).String(), "-",
+			timestamp.Time(start+bh.compactionRange).String())
+		id, err := bh.compactBlocks(compactor, bh.blocksDir(p), metas)
+		if err != nil {
+			ids := make([]ulid.ULID, 0, len(metas))
+			for _, meta := range metas {
+				ids = append(ids, meta.ULID)
+			}
+			bh.reportError(&CompactionError{Dir: bh.blocksDir(p), Blocks: ids, Err: err})
+			flushed = append(flushed, ids...)
+			continue
+		}
+		flushed = append(flushed, id)
+	}
+	p.flushed = flushed
+}
+
+// compactBlocks compacts the blocks into a new one, verifies it and deletes the original blocks
+func (bh *Handler) compactBlocks(compactor *tsdb.LeveledCompactor, dir string,
+	metas []tsdb.BlockMeta) (ulid.ULID, error) {
+	sort.Slice(metas, func(i, j int) bool {
+		return metas[i].MinTime < metas[j].MinTime
+	})
+	dirs := make([]string, 0, len(metas))
+	var samples, maxSeries uint64
+	minTime, maxTime := int64(math.MaxInt64), int64(math.MinInt64)
+	for _, meta := range metas {
+		dirs = append(dirs, filepath.Join(dir, meta.ULID.String()))
+		samples += meta.Stats.NumSamples
+		if meta.Stats.NumSeries > maxSeries {
+			maxSeries = meta.Stats.NumSeries
+		}
+		if meta.MinTime < minTime {
+			minTime = meta.MinTime
+		}
+		if meta.MaxTime > maxTime {
+			maxTime = meta.MaxTime
+		}
+	}
+	id, err := compactor.Compact(dir, dirs, nil)
+	if err != nil {
+		return id, err
+	}
+	if id == (ulid.ULID{}) {
+		return id, fmt.Errorf("compaction of %v resulted in an empty block", dirs)
+	}
+	if err := verifyCompacted(filepath.Join(dir, id.String()), minTime, maxTime, samples, maxSeries); err != nil {
+		_ = os.RemoveAll(filepath.Join(dir, id.String()))
+		return id, fmt.Errorf("verification of the compacted block %s failed: %w", id, err)
+	}
+	for _, d := range dirs {
+		if err := os.RemoveAll(d); err != nil {
+			ErrLog("Error deleting the compacted block %s: %v\n", d, err)
+		}
+	}
+	Notice3("Blocks compacted into", id.String())
+	return id, nil
+}
+
+// verifyCompacted checks the compacted block in dir against the stats of the original blocks, and its index
+func verifyCompacted(dir string, minTime, maxTime int64, samples, maxSeries uint64) error {
+	b, err := tsdb.OpenBlock(log.NewNopLogger(), dir, nil)
+	if err != nil {
+		return err
+	}
+	defer b.Close()
+	compacted := b.Meta()
+	switch {
+	case compacted.MinTime != minTime || compacted.MaxTime != maxTime:
+		return fmt.Errorf("range [%d, %d), expected [%d, %d)", compacted.MinTime, compacted.MaxTime, minTime, maxTime)
+	case compacted.Stats.NumSamples == 0 || compacted.Stats.NumSamples > samples: // Overlapping samples are merged
+		return fmt.Errorf("%d samples, expected at most %d", compacted.Stats.NumSamples, samples)
+	case compacted.Stats.NumSeries < maxSeries:
+		return fmt.Errorf("%d series, expected at least %d", compacted.Stats.NumSeries, maxSeries)
+	}
+	return verifyIndex(b)
+}
+
+// readBlockMeta opens the block in dir to read its meta
+func readBlockMeta(dir string) (tsdb.BlockMeta, error) {
+	b, err := tsdb.OpenBlock(log.NewNopLogger(), dir, nil)
+	if err != nil {
+		return tsdb.BlockMeta{}, err
+	}
+	defer b.Close()
+	return b.Meta(), nil
+}
@@ -0,0 +1,51 @@
+package prometheus_backfill
+
+import (
+	"context"
+	"errors"
+	"github.com/oklog/ulid"
+	"testing"
+	"time"
+)
+
+func TestCompaction(t *testing.T) {
+	dir := t.TempDir()
+	hour := int64(time.Hour / time.Millisecond)
+	var tables []interface{}
+	for i := int64(0); i < 6; i++ { // A block per hour, two compacted blocks of 3 hours
+		tables = append(tables, []Sample{gauge("m", i*hour, float64(i)), gauge("m", i*hour+1, float64(i))})
+	}
+	_, err := runTestJob(t, Options{OutputDir: dir, BlockDuration: time.Hour, CompactionRange: 3 * time.Hour}, tables...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocks := readTestBlocks(t, dir)
+	if len(blocks) != 2 {
+		t.Fatalf("%d blocks, expected 2", len(blocks))
+	}
+	checkNoOverlaps(t, blocks)
+	for i, b := range blocks {
+		if b.meta.Stats.NumSamples != 6 || b.meta.MinTime != int64(i)*3*hour {
+			t.Errorf("block %d: [%d, %d) with %d samples", i, b.meta.MinTime, b.meta.MaxTime, b.meta.Stats.NumSamples)
+		}
+	}
+}
+
+func TestCompactionErrors(t *testing.T) {
+	dir := t.TempDir()
+	bh, err := New(nil, Options{OutputDir: dir, CompactionRange: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := newWriterPool(context.Background(), dir, dir, "", bh.blockDuration, 1, 1, bh.newBlockWriter)
+	missing := ulid.MustNew(1, nil)
+	p.flushed = []ulid.ULID{missing, ulid.MustNew(2, nil)}
+	bh.compact(p)
+	var compactionErr *CompactionError
+	if !errors.As(bh.err(), &compactionErr) || compactionErr.Blocks[0] != missing {
+		t.Fatalf("error %v, expected a compaction error of block %s", bh.err(), missing)
+	}
+	if len(p.flushed) != 2 {
+		t.Errorf("blocks %v left, expected the ones that can't be compacted", p.flushed)
+	}
+}
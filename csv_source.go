@@ -0,0 +1,379 @@
+package prometheus_backfill
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"github.com/prometheus/prometheus/pkg/timestamp"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultCSVBatchSize = 1000
+
+// CSVHeader tells whether the first record of a CSV file is a header
+type CSVHeader string
+
+const (
+	CSVHeaderAuto    CSVHeader = ""        // The first record is a header if columns are referenced by name, or if its timestamp isn't valid
+	CSVHeaderPresent CSVHeader = "present" // The first record is a header
+	CSVHeaderAbsent  CSVHeader = "absent"  // The first record is data: columns can only be referenced by index
+)
+
+// CSVOptions maps the columns of CSV (or TSV) files to samples. Columns are referenced by their name in the header, or
+// by their index (from 0) if there's no header
+type CSVOptions struct {
+	Comma           rune // Field delimiter (by default '\t' for the .tsv files, ',' otherwise)
+	Header          CSVHeader
+	Timestamp       string // Column of the timestamp
+	TimestampFormat string // s (the default, may be fractional), ms, us, ns or a layout of the time package (e.g. time.RFC3339)
+	// Columns of the labels of the samples: label name => column. Empty cells are missing labels, records too short for
+	// the columns are rejected. The invalid characters of the label names are replaced with '_' (see sanitizeName)
+	Labels    map[string]string
+	Metrics   []CSVMetric
+	BatchSize int // Records of each table (1k by default)
+}
+
+// CSVMetric is a column of metric values. Empty cells are missing samples, missing cells (in records too short) are
+// rejected
+type CSVMetric struct {
+	Column string
+	Name   string            // Metric name (the name of the column by default), sanitized as the label names
+	Type   string            // counter or gauge (the default); the names of the counters end with _total, as for the prometheus tags
+	Unit   string            // Added as the unit label, as for the prometheus tags
+	Labels map[string]string // Constant labels of the metric
+}
+
+// CSVSource reads a CSV file, optionally gzipped (.gz)
+type CSVSource struct {
+	path      string
+	opts      *CSVOptions
+	file      io.ReadCloser
+	reader    *csv.Reader
+	mapping   *csvMapping
+	first     []string // First record, if it is not a header
+	line      int      // Line of the last record read
+	exhausted bool
+}
+
+// csvMapping is the mapping of the options, with the columns resolved to their index
+type csvMapping struct {
+	header    []string // nil if the file has no header
+	timestamp int
+	labels    map[string]int
+	metrics   []csvMetric
+}
+
+type csvMetric struct {
+	column int
+	name   string
+	typ    string
+	labels map[string]string
+}
+
+// CSVSources returns the sources of the CSV files matching the patterns (see filepath.Match; a directory matches all
+// the .csv, .tsv, .csv.gz and .tsv.gz files below it)
+func CSVSources(opts CSVOptions, patterns ...string) ([]Source, error) {
+	switch {
+	case opts.Timestamp == "":
+		return nil, errors.New("invalid CSV options: the timestamp column is required")
+	case len(opts.Metrics) == 0:
+		return nil, errors.New("invalid CSV options: no metric columns")
+	}
+	switch opts.Header {
+	case CSVHeaderAuto, CSVHeaderPresent, CSVHeaderAbsent:
+	default:
+		return nil, fmt.Errorf("invalid CSV options: unknown header mode %s", opts.Header)
+	}
+	for _, m := range opts.Metrics {
+		switch m.Type {
+		case "counter", "gauge", "":
+		default:
+			return nil, fmt.Errorf("invalid CSV options: unknown metric type %s of column %s", m.Type, m.Column)
+		}
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = defaultCSVBatchSize
+	}
+	files, err := sourceFiles(patterns, ".csv", ".tsv", ".csv.gz", ".tsv.gz")
+	if err != nil {
+		return nil, err
+	}
+	sources := make([]Source, 0, len(files))
+	for _, path := range files {
+		sources = append(sources, &CSVSource{path: path, opts: &opts})
+	}
+	return sources, nil
+}
+
+func (cs *CSVSource) Open(context.Context) error {
+	var err error
+	if cs.file, err = openSourceFile(cs.path); err != nil {
+		return err
+	}
+	cs.reader = csv.NewReader(cs.file)
+	cs.reader.FieldsPerRecord = -1 // Ragged records are rejected by the error policy of the job, see csvTable.samples
+	switch {
+	case cs.opts.Comma != 0:
+		cs.reader.Comma = cs.opts.Comma
+	case strings.HasSuffix(strings.TrimSuffix(cs.path, ".gz"), ".tsv"):
+		cs.reader.Comma = '\t'
+	}
+	first, err := cs.read()
+	if errors.Is(err, io.EOF) {
+		cs.exhausted = true
+		return nil
+	}
+	if err != nil {
+		_ = cs.file.Close()
+		return err
+	}
+	var header []string
+	if cs.isHeader(first) {
+		header = first
+	} else {
+		cs.first = first
+	}
+	if cs.mapping, err = cs.opts.mapping(header); err != nil {
+		_ = cs.file.Close()
+		return err
+	}
+	return nil
+}
+
+func (cs *CSVSource) read() ([]string, error) {
+	record, err := cs.reader.Read()
+	if err != nil {
+		return nil, err
+	}
+	cs.line, _ = cs.reader.FieldPos(0)
+	return record, nil
+}
+
+// isHeader tells whether the first record is a header
+func (cs *CSVSource) isHeader(first []string) bool {
+	switch cs.opts.Header {
+	case CSVHeaderPresent:
+		return true
+	case CSVHeaderAbsent:
+		return false
+	}
+	for _, c := range cs.opts.columns() {
+		if _, err := strconv.Atoi(c); err != nil {
+			return true // Named columns can only be resolved with a header
+		}
+	}
+	if i, _ := strconv.Atoi(cs.opts.Timestamp); i < len(first) {
+		_, err := parseCSVTimestamp(first[i], cs.opts.TimestampFormat)
+		return err != nil
+	}
+	return false
+}
+
+// columns returns the columns referenced by the options
+func (o *CSVOptions) columns() []string {
+	columns := []string{o.Timestamp}
+	for _, c := range o.Labels {
+		columns = append(columns, c)
+	}
+	for _, m := range o.Metrics {
+		columns = append(columns, m.Column)
+	}
+	return columns
+}
+
+// mapping resolves the columns of the options with the header (nil if the file has no header)
+func (o *CSVOptions) mapping(header []string) (*csvMapping, error) {
+	index := func(column string) (int, error) {
+		for i, name := range header {
+			if name == column {
+				return i, nil
+			}
+		}
+		if i, err := strconv.Atoi(column); err == nil && i >= 0 {
+			return i, nil
+		}
+		return 0, fmt.Errorf("no column %s", column)
+	}
+	var err error
+	m := &csvMapping{header: header, labels: make(map[string]int, len(o.Labels))}
+	if m.timestamp, err = index(o.Timestamp); err != nil {
+		return nil, err
+	}
+	for label, column := range o.Labels {
+		if m.labels[sanitizeName(label, false)], err = index(column); err != nil {
+			return nil, err
+		}
+	}
+	for _, metric := range o.Metrics {
+		cm := csvMetric{name: metric.Name, typ: metric.Type, labels: make(map[string]string, len(metric.Labels)+1)}
+		if cm.column, err = index(metric.Column); err != nil {
+			return nil, err
+		}
+		if cm.name == "" {
+			if cm.column >= len(header) {
+				return nil, fmt.Errorf("no name for the metric of column %s, with no header", metric.Column)
+			}
+			cm.name = header[cm.column]
+		}
+		if cm.name = sanitizeName(cm.name, true); cm.name == "" {
+			return nil, fmt.Errorf("no name for the metric of column %s", metric.Column)
+		}
+		if cm.typ == "counter" && !strings.HasSuffix(cm.name, "_total") {
+			cm.name += "_total"
+		}
+		for k, v := range metric.Labels {
+			cm.labels[sanitizeName(k, false)] = v
+		}
+		if metric.Unit != "" {
+			cm.labels["unit"] = metric.Unit
+		}
+		m.metrics = append(m.metrics, cm)
+	}
+	return m, nil
+}
+
+// name returns the name of the column in the header, or its index
+func (m *csvMapping) name(column int) string {
+	if column < len(m.header) {
+		return m.header[column]
+	}
+	return strconv.Itoa(column)
+}
+
+// Next returns the next batch of records, converted into samples by the handler
+func (cs *CSVSource) Next(context.Context) (interface{}, error) {
+	if cs.exhausted {
+		return nil, io.EOF
+	}
+	table := &csvTable{source: cs, mapping: cs.mapping}
+	if cs.first != nil {
+		table.records = append(table.records, cs.first)
+		table.lines = append(table.lines, cs.line)
+		cs.first = nil
+	}
+	for len(table.records) < cs.opts.BatchSize {
+		record, err := cs.read()
+		if errors.Is(err, io.EOF) {
+			cs.exhausted = true
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		table.records = append(table.records, record)
+		table.lines = append(table.lines, cs.line)
+	}
+	if len(table.records) == 0 {
+		return nil, io.EOF
+	}
+	return table, nil
+}
+
+func (cs *CSVSource) Close() error {
+	return cs.file.Close()
+}
+
+func (cs *CSVSource) String() string {
+	return cs.path
+}
+
+// csvTable is a batch of records of a CSV file
+type csvTable struct {
+	source  *CSVSource
+	mapping *csvMapping
+	records [][]string
+	lines   []int
+}
+
+func (t *csvTable) samples(reject func(err error, row interface{})) []Sample {
+	m := t.mapping
+	samples := make([]Sample, 0, len(t.records)*len(m.metrics))
+	for r, record := range t.records {
+		fail := func(column int, reason string) {
+			reject(&SchemaError{
+				Type:   t.source.path,
+				Field:  m.name(column),
+				Reason: fmt.Sprintf("line %d: %s", t.lines[r], reason),
+			}, record)
+		}
+		if m.timestamp >= len(record) {
+			fail(m.timestamp, "missing timestamp")
+			continue
+		}
+		ts, err := parseCSVTimestamp(record[m.timestamp], t.source.opts.TimestampFormat)
+		if err != nil {
+			fail(m.timestamp, err.Error())
+			continue
+		}
+		labels := make(map[string]string, len(m.labels))
+		missing := -1 // Label column missing from the record
+		for label, column := range m.labels {
+			switch {
+			case column >= len(record):
+				if missing < 0 || column < missing {
+					missing = column
+				}
+			case record[column] != "":
+				labels[label] = record[column]
+			}
+		}
+		if missing >= 0 {
+			fail(missing, "missing label")
+			continue
+		}
+		for _, metric := range m.metrics {
+			if metric.column >= len(record) {
+				fail(metric.column, "missing value")
+				continue
+			}
+			if record[metric.column] == "" {
+				continue
+			}
+			v, err := strconv.ParseFloat(record[metric.column], 64)
+			if err != nil {
+				fail(metric.column, err.Error())
+				continue
+			}
+			s := Sample{
+				Labels:    make(map[string]string, len(labels)+len(metric.labels)+1),
+				Timestamp: ts,
+				Value:     v,
+				Type:      metric.typ,
+			}
+			for k, l := range labels {
+				s.Labels[k] = l
+			}
+			for k, l := range metric.labels {
+				s.Labels[k] = l
+			}
+			s.Labels["__name__"] = metric.name
+			samples = append(samples, s)
+		}
+	}
+	return samples
+}
+
+// parseCSVTimestamp parses a timestamp in the format (see CSVOptions.TimestampFormat) into ms
+func parseCSVTimestamp(s, format string) (int64, error) {
+	switch format {
+	case "", "s":
+		f, err := strconv.ParseFloat(s, 64)
+		return int64(f * 1000), err
+	case "ms", "us", "ns":
+		i, err := strconv.ParseInt(s, 10, 64)
+		switch format {
+		case "us":
+			i /= 1e3
+		case "ns":
+			i /= 1e6
+		}
+		return i, err
+	default:
+		t, err := time.Parse(format, s)
+		return timestamp.FromTime(t), err
+	}
+}
@@ -0,0 +1,211 @@
+package prometheus_backfill
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	labels2 "github.com/prometheus/prometheus/pkg/labels"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseCSVTimestamp(t *testing.T) {
+	tests := []struct {
+		s, format string
+		ms        int64
+		err       bool
+	}{
+		{"1600000000", "", 1600000000000, false},
+		{"1600000000", "s", 1600000000000, false},
+		{"1600000000.5", "s", 1600000000500, false},
+		{"1600000000.123", "s", 1600000000123, false},
+		{"0.001", "s", 1, false},
+		{"1600000000123", "ms", 1600000000123, false},
+		{"1600000000123456", "us", 1600000000123, false},
+		{"1600000000123456789", "ns", 1600000000123, false},
+		{"2020-09-13T12:26:40Z", time.RFC3339, 1600000000000, false},
+		{"2020-09-13T14:26:40.25+02:00", time.RFC3339Nano, 1600000000250, false},
+		{"2020-09-13 12:26:40", "2006-01-02 15:04:05", 1600000000000, false},
+		{"", "s", 0, true},
+		{"now", "s", 0, true},
+		{"1600000000.5", "ms", 0, true},
+		{"1600000000", time.RFC3339, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format+"/"+tt.s, func(t *testing.T) {
+			ms, err := parseCSVTimestamp(tt.s, tt.format)
+			if (err != nil) != tt.err {
+				t.Fatalf("error %v, expected an error: %t", err, tt.err)
+			}
+			if !tt.err && ms != tt.ms {
+				t.Errorf("%d ms, expected %d", ms, tt.ms)
+			}
+		})
+	}
+}
+
+func TestCSVRaggedRecords(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.csv")
+	data := "time,host,cpu,mem\n" +
+		"1,a,0.5,10\n" +
+		"2,a,0.6\n" + // Missing mem cell
+		"3,a\n" + // Missing cpu and mem cells
+		"4\n" + // Missing host label
+		"5,a,,30\n" // Empty cpu cell: no sample
+	if err := ioutil.WriteFile(path, []byte(data), 0666); err != nil {
+		t.Fatal(err)
+	}
+	sources, err := CSVSources(CSVOptions{
+		Timestamp: "time",
+		Labels:    map[string]string{"host": "host"},
+		Metrics:   []CSVMetric{{Column: "cpu"}, {Column: "mem"}},
+	}, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs := sources[0]
+	if err := cs.Open(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer cs.Close()
+	table, err := cs.Next(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fields []string
+	samples := table.(*csvTable).samples(func(err error, row interface{}) {
+		var schemaErr *SchemaError
+		if !errors.As(err, &schemaErr) {
+			t.Fatalf("error %v, expected a schema error", err)
+		}
+		fields = append(fields, schemaErr.Field)
+	})
+	if len(samples) != 4 {
+		t.Errorf("%d samples, expected 4: %v", len(samples), samples)
+	}
+	expected := []string{"mem", "cpu", "mem", "host"}
+	if len(fields) != len(expected) {
+		t.Fatalf("rejected fields %v, expected %v", fields, expected)
+	}
+	for i := range expected {
+		if fields[i] != expected[i] {
+			t.Errorf("rejected fields %v, expected %v", fields, expected)
+			break
+		}
+	}
+}
+
+// readCSV reads the samples of the CSV file with the content (gzipped if its name ends with .gz)
+func readCSV(t *testing.T, opts CSVOptions, name, content string) []Sample {
+	t.Helper()
+	var data bytes.Buffer
+	if strings.HasSuffix(name, ".gz") {
+		gz := gzip.NewWriter(&data)
+		_, _ = gz.Write([]byte(content))
+		if err := gz.Close(); err != nil {
+			t.Fatal(err)
+		}
+	} else {
+		data.WriteString(content)
+	}
+	path := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(path, data.Bytes(), 0666); err != nil {
+		t.Fatal(err)
+	}
+	sources, err := CSVSources(opts, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs := sources[0]
+	if err := cs.Open(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer cs.Close()
+	var samples []Sample
+	for {
+		table, err := cs.Next(context.Background())
+		if err == io.EOF {
+			return samples
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		samples = append(samples, table.(*csvTable).samples(func(err error, row interface{}) {
+			t.Errorf("record %v rejected: %v", row, err)
+		})...)
+	}
+}
+
+func TestCSVHeader(t *testing.T) {
+	byName := CSVOptions{Timestamp: "time", Labels: map[string]string{"host name": "host"},
+		Metrics: []CSVMetric{{Column: "cpu usage (%)"},
+			{Column: "net", Type: "counter", Labels: map[string]string{"dir-ection": "in"}}}}
+	byIndex := CSVOptions{Timestamp: "0", Labels: map[string]string{"host": "1"},
+		Metrics: []CSVMetric{{Column: "2", Name: "cpu"}, {Column: "3", Name: "net", Type: "counter"}}}
+	withHeader := "time,host,cpu usage (%),net\n1,a,0.5,10\n2,b,0.6,20\n"
+	noHeader := "1,a,0.5,10\n2,b,0.6,20\n"
+	tests := []struct {
+		name, file, content string
+		opts                CSVOptions
+		samples             []string // Series of the samples, by timestamp
+	}{
+		{"named columns", "data.csv", withHeader, byName,
+			[]string{`1000 {__name__="cpu_usage____", host_name="a"}`, `1000 {__name__="net_total", dir_ection="in", host_name="a"}`,
+				`2000 {__name__="cpu_usage____", host_name="b"}`, `2000 {__name__="net_total", dir_ection="in", host_name="b"}`}},
+		{"gzipped", "data.csv.gz", withHeader, byName,
+			[]string{`1000 {__name__="cpu_usage____", host_name="a"}`, `1000 {__name__="net_total", dir_ection="in", host_name="a"}`,
+				`2000 {__name__="cpu_usage____", host_name="b"}`, `2000 {__name__="net_total", dir_ection="in", host_name="b"}`}},
+		{"indexed columns and a header", "data.csv", withHeader, byIndex, // The timestamp of the header is invalid
+			[]string{`1000 {__name__="cpu", host="a"}`, `1000 {__name__="net_total", host="a"}`,
+				`2000 {__name__="cpu", host="b"}`, `2000 {__name__="net_total", host="b"}`}},
+		{"indexed columns and no header", "data.tsv.gz", strings.ReplaceAll(noHeader, ",", "\t"), byIndex,
+			[]string{`1000 {__name__="cpu", host="a"}`, `1000 {__name__="net_total", host="a"}`,
+				`2000 {__name__="cpu", host="b"}`, `2000 {__name__="net_total", host="b"}`}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var series []string
+			for _, s := range readCSV(t, tt.opts, tt.file, tt.content) {
+				series = append(series, fmt.Sprint(s.Timestamp, " ", labels2.FromMap(s.Labels)))
+			}
+			sort.Strings(series)
+			if !reflect.DeepEqual(series, tt.samples) {
+				t.Errorf("samples %v, expected %v", series, tt.samples)
+			}
+		})
+	}
+}
+
+func TestCSVHeaderAbsent(t *testing.T) {
+	// The first record is data even if its timestamp is invalid: it is rejected
+	path := filepath.Join(t.TempDir(), "data.csv")
+	if err := ioutil.WriteFile(path, []byte("time,cpu\n1,0.5\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	sources, err := CSVSources(CSVOptions{Header: CSVHeaderAbsent, Timestamp: "0",
+		Metrics: []CSVMetric{{Column: "1", Name: "cpu"}}}, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sources[0].Open(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer sources[0].Close()
+	table, err := sources[0].Next(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	rejected := 0
+	samples := table.(*csvTable).samples(func(error, interface{}) { rejected++ })
+	if len(samples) != 1 || rejected != 1 {
+		t.Errorf("%d samples and %d rejected records, expected 1 and 1", len(samples), rejected)
+	}
+}
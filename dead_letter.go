@@ -0,0 +1,130 @@
+package prometheus_backfill
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	io_prometheus_client "github.com/prometheus/client_model/go"
+	"os"
+	"reflect"
+	"strconv"
+)
+
+// DeadLetter is a rejected sample, or a row that couldn't be converted into samples, as written in the dead-letter file
+type DeadLetter struct {
+	Reason    string            `json:"reason"`
+	Labels    map[string]string `json:"labels,omitempty"`    // Labels of the sample
+	Timestamp int64             `json:"timestamp,omitempty"` // ms
+	Value     string            `json:"value,omitempty"`     // Value of the sample, as formatted by strconv (NaN, +Inf...)
+	Row       json.RawMessage   `json:"row,omitempty"`       // JSON of the row
+}
+
+// setDeadLetter opens the dead-letter file at path, for appending
+func (bh *Handler) setDeadLetter(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return fmt.Errorf("unable to open the dead-letter file %s: %w", path, err)
+	}
+	bh.deadLetters = f
+	return nil
+}
+
+// ReadDeadLetters reads a dead-letter file
+func ReadDeadLetters(path string) ([]DeadLetter, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var letters []DeadLetter
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<24)
+	for line := 1; scanner.Scan(); line++ {
+		var l DeadLetter
+		if err := json.Unmarshal(scanner.Bytes(), &l); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		letters = append(letters, l)
+	}
+	return letters, scanner.Err()
+}
+
+// deadLetter writes the rejected sample (from an AppendError) or row into the dead-letter file, if any. It is
+// thread-safe
+func (bh *Handler) deadLetter(err error, row interface{}) {
+	if bh.deadLetters == nil {
+		return
+	}
+	l := DeadLetter{Reason: err.Error()}
+	var appendErr *AppendError
+	if replayed, ok := row.(*DeadLetter); ok {
+		l = *replayed
+		l.Reason = err.Error()
+	} else if errors.As(err, &appendErr) {
+		l.Labels = appendErr.Labels.Map()
+		l.Timestamp = appendErr.Timestamp
+		l.Value = strconv.FormatFloat(appendErr.Value, 'g', -1, 64)
+	} else if row != nil {
+		if s, ok := row.(*Sample); ok {
+			l.Timestamp = s.Timestamp // Already in ms
+		} else if v := reflect.Indirect(reflect.ValueOf(row)); v.Kind() == reflect.Struct {
+			if ts := v.FieldByName("Timestamp"); ts.IsValid() && ts.Kind() == reflect.Int64 {
+				l.Timestamp = ts.Int() * 1000
+			}
+		}
+		b, jerr := json.Marshal(row)
+		if jerr != nil {
+			l.Reason += " (the row can't be encoded: " + jerr.Error() + ")"
+		} else {
+			l.Row = b
+		}
+	}
+	b, jerr := json.Marshal(l)
+	if jerr != nil {
+		bh.fail(fmt.Errorf("unable to encode the dead letter: %w", jerr))
+		return
+	}
+	bh.deadLettersLock.Lock()
+	_, werr := bh.deadLetters.Write(append(b, '\n'))
+	bh.deadLettersLock.Unlock()
+	if werr != nil {
+		bh.fail(fmt.Errorf("unable to write the dead letter: %w", werr))
+		return
+	}
+	bh.deadLetterCount.Inc()
+}
+
+// closeDeadLetters closes the dead-letter file, if any
+func (bh *Handler) closeDeadLetters() {
+	if bh.deadLetters == nil {
+		return
+	}
+	if err := bh.deadLetters.Close(); err != nil {
+		bh.fail(fmt.Errorf("unable to close the dead-letter file: %w", err))
+	}
+}
+
+// replay inserts the samples of the dead letters into the time index, as gauges. Rows are rejected again
+func (bh *Handler) replay(letters []DeadLetter) {
+	for i := range letters {
+		l := &letters[i]
+		if len(l.Labels) == 0 {
+			bh.rowError(&SchemaError{Type: "DeadLetter", Reason: "rows can't be replayed as dead letters"}, l)
+			continue
+		}
+		v, err := strconv.ParseFloat(l.Value, 64)
+		if err != nil {
+			bh.rowError(&SchemaError{Type: "DeadLetter", Field: "Value", Reason: err.Error()}, l)
+			continue
+		}
+		ts := l.Timestamp
+		bh.indexLock.Lock()
+		bh.index.insert([]*io_prometheus_client.Metric{{
+			Label:       bh.marshalLabelsMap(l.Labels),
+			Gauge:       &io_prometheus_client.Gauge{Value: &v},
+			TimestampMs: &ts,
+		}})
+		bh.indexLock.Unlock()
+	}
+}
@@ -0,0 +1,67 @@
+package prometheus_backfill
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDeadLettersReplay(t *testing.T) {
+	hour := int64(time.Hour / time.Millisecond)
+	path := filepath.Join(t.TempDir(), "dead-letters.jsonl")
+	_, err := runTestJob(t, Options{
+		OutputDir:           t.TempDir(),
+		BlockDuration:       time.Hour,
+		StoreThreshold:      1,
+		MaxParallelConsumes: 1,
+		ErrorPolicy:         ErrorSkip,
+		LatePolicy:          LateFail,
+		AllowedLateness:     time.Hour,
+		DeadLetterPath:      path,
+	},
+		[]Sample{noName(1000)},
+		[]Sample{gauge("m", 3*hour, 1)},
+		[]Sample{gauge("m", hour/2, 2, "id", "late")}, // Fails the job
+	)
+	if !errors.Is(err, ErrLateSample) {
+		t.Fatalf("error %v, expected a late sample", err)
+	}
+	letters, err := ReadDeadLetters(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(letters) != 2 {
+		t.Fatalf("dead letters %+v, expected 2", letters)
+	}
+	row, sample := letters[0], letters[1]
+	if len(row.Row) == 0 || row.Labels != nil || row.Timestamp != 1000 {
+		t.Errorf("dead letter %+v, expected the row with no name", row)
+	}
+	if sample.Labels["__name__"] != "m" || sample.Labels["id"] != "late" || sample.Timestamp != hour/2 ||
+		sample.Value != "2" || len(sample.Row) != 0 {
+		t.Errorf("dead letter %+v, expected the late sample", sample)
+	}
+
+	// The sample is replayed, the row is rejected again
+	dir, replayPath := t.TempDir(), filepath.Join(t.TempDir(), "dead-letters.jsonl")
+	bh, err := runTestJob(t, Options{OutputDir: dir, BlockDuration: time.Hour, ErrorPolicy: ErrorSkip,
+		DeadLetterPath: replayPath}, letters)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := bh.rowErrorCount.Load(); n != 1 {
+		t.Errorf("%d row errors, expected 1", n)
+	}
+	blocks := readTestBlocks(t, dir)
+	if len(blocks) != 1 || !equalTestSamples(blocks[0].series[`{__name__="m", id="late"}`], []testSample{{hour / 2, 2}}) {
+		t.Errorf("blocks %+v, expected the replayed sample", blocks)
+	}
+	letters, err = ReadDeadLetters(replayPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(letters) != 1 || string(letters[0].Row) != string(row.Row) {
+		t.Errorf("dead letters %+v, expected the row", letters)
+	}
+}
@@ -0,0 +1,85 @@
+package prometheus_backfill
+
+import (
+	"fmt"
+	io_prometheus_client "github.com/prometheus/client_model/go"
+	labels2 "github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/storage"
+	"math"
+	"strconv"
+)
+
+// DuplicatePolicy tells how to resolve the samples with the same labels at the same timestamp
+// (e.g. two rows producing the same label set).
+type DuplicatePolicy string
+
+const (
+	DuplicateKeepFirst DuplicatePolicy = "keep_first" // Default
+	DuplicateKeepLast  DuplicatePolicy = "keep_last"
+	DuplicateSum       DuplicatePolicy = "sum"
+	DuplicateMax       DuplicatePolicy = "max"
+	DuplicateFail      DuplicatePolicy = "fail"
+)
+
+func (p DuplicatePolicy) validate() error {
+	switch p {
+	case DuplicateKeepFirst, DuplicateKeepLast, DuplicateSum, DuplicateMax, DuplicateFail:
+		return nil
+	}
+	return fmt.Errorf("unknown duplicate policy %s", p)
+}
+
+// deduplicate resolves the duplicates among the samples of a block range with the same timestamp, in arrival order.
+// deduplicate is not thread-safe! Use with the writerLock.
+func (bh *Handler) deduplicate(toStore []auxStoreStruct) []auxStoreStruct {
+	ret := make([]auxStoreStruct, 0, len(toStore))
+	seen := make(map[string]int) // sample key => index in ret
+	for _, m := range toStore {
+		key := strconv.FormatInt(*m.metric.TimestampMs, 10) + labels2.Labels(m.labels).String()
+		i, ok := seen[key]
+		if !ok {
+			seen[key] = len(ret)
+			ret = append(ret, m)
+			continue
+		}
+		bh.countDuplicate(m.labels)
+		switch bh.duplicatePolicy {
+		case DuplicateKeepLast:
+			ret[i] = m
+		case DuplicateSum:
+			ret[i] = withValue(ret[i], sampleValue(ret[i].metric)+sampleValue(m.metric))
+		case DuplicateMax:
+			ret[i] = withValue(ret[i], math.Max(sampleValue(ret[i].metric), sampleValue(m.metric)))
+		case DuplicateFail:
+			err := &AppendError{Labels: m.labels, Timestamp: *m.metric.TimestampMs, Value: sampleValue(m.metric),
+				Err: storage.ErrDuplicateSampleForTimestamp}
+			bh.deadLetter(err, nil)
+			bh.fail(err)
+		default: // DuplicateKeepFirst
+		}
+	}
+	return ret
+}
+
+// countDuplicate is thread-safe
+func (bh *Handler) countDuplicate(labels []labels2.Label) {
+	bh.duplicatesLock.Lock()
+	if bh.duplicates == nil {
+		bh.duplicates = make(map[string]int64)
+	}
+	bh.duplicates[labels2.Labels(labels).Get(labels2.MetricName)]++
+	bh.duplicatesLock.Unlock()
+}
+
+// withValue returns a copy of the sample with the value v
+func withValue(m auxStoreStruct, v float64) auxStoreStruct {
+	metric := *m.metric
+	switch {
+	case metric.Counter != nil:
+		metric.Counter = &io_prometheus_client.Counter{Value: &v}
+	default:
+		metric.Gauge = &io_prometheus_client.Gauge{Value: &v}
+	}
+	m.metric = &metric
+	return m
+}
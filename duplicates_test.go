@@ -0,0 +1,75 @@
+package prometheus_backfill
+
+import (
+	"errors"
+	"github.com/prometheus/prometheus/storage"
+	"testing"
+	"time"
+)
+
+func TestDuplicatesAcrossBatches(t *testing.T) {
+	tests := []struct {
+		policy DuplicatePolicy
+		value  float64
+	}{
+		{DuplicateKeepFirst, 1},
+		{DuplicateKeepLast, 5},
+		{DuplicateSum, 6},
+		{DuplicateMax, 5},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.policy), func(t *testing.T) {
+			dir := t.TempDir()
+			// The duplicates are in different tables and batches, with other samples in between
+			bh, err := runTestJob(t, Options{
+				OutputDir:           dir,
+				BlockDuration:       time.Hour,
+				StoreThreshold:      1,
+				MaxParallelConsumes: 1,
+				DuplicatePolicy:     tt.policy,
+			},
+				[]Sample{gauge("m", 1000, 1)},
+				[]Sample{gauge("m", 2000, 2)},
+				[]Sample{gauge("m", 1000, 5)},
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if duplicates := bh.Progress().Duplicates; len(duplicates) != 1 || duplicates["m"] != 1 {
+				t.Errorf("duplicates %v, expected 1 of m", duplicates)
+			}
+			blocks := readTestBlocks(t, dir)
+			if len(blocks) != 1 {
+				t.Fatalf("%d blocks, expected 1", len(blocks))
+			}
+			samples := blocks[0].series[`{__name__="m"}`]
+			if len(samples) != 2 || samples[0] != (testSample{1000, tt.value}) || samples[1] != (testSample{2000, 2}) {
+				t.Errorf("samples %v, expected %v at 1000", samples, tt.value)
+			}
+		})
+	}
+}
+
+func TestDuplicateFailAcrossBatches(t *testing.T) {
+	bh, err := runTestJob(t, Options{
+		OutputDir:           t.TempDir(),
+		BlockDuration:       time.Hour,
+		StoreThreshold:      1,
+		MaxParallelConsumes: 1,
+		DuplicatePolicy:     DuplicateFail,
+	},
+		[]Sample{gauge("m", 1000, 1)},
+		[]Sample{gauge("m", 2000, 2)},
+		[]Sample{gauge("m", 1000, 5)},
+	)
+	var appendErr *AppendError
+	if !errors.As(err, &appendErr) || !errors.Is(err, storage.ErrDuplicateSampleForTimestamp) {
+		t.Fatalf("error %v, expected a duplicate sample", err)
+	}
+	if appendErr.Timestamp != 1000 {
+		t.Errorf("duplicate at %d, expected 1000", appendErr.Timestamp)
+	}
+	if n := bh.Progress().Duplicates["m"]; n != 1 {
+		t.Errorf("%d duplicates, expected 1", n)
+	}
+}
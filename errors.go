@@ -0,0 +1,176 @@
+package prometheus_backfill
+
+import (
+	"errors"
+	"fmt"
+	"github.com/oklog/ulid"
+	labels2 "github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/pkg/timestamp"
+)
+
+// ErrLateSample is wrapped by the AppendError of a sample older than the watermark, with the LateFail policy
+var ErrLateSample = errors.New("late sample")
+
+// ErrTooManyRowErrors is returned by RunJob when the ErrorCollect policy collected more than its maximum of errors
+var ErrTooManyRowErrors = errors.New("too many row errors")
+
+// SchemaError is a table, a row or a field that can't be converted into samples
+type SchemaError struct {
+	Type   string // Type of the table or of the row
+	Field  string // Field of the row, if any
+	Reason string
+}
+
+func (e *SchemaError) Error() string {
+	if e.Field == "" {
+		return fmt.Sprintf("schema error in %s: %s", e.Type, e.Reason)
+	}
+	return fmt.Sprintf("schema error in %s.%s: %s", e.Type, e.Field, e.Reason)
+}
+
+// AppendError is a sample rejected by a block writer or by the policies of the job
+type AppendError struct {
+	Labels    labels2.Labels
+	Timestamp int64 // ms
+	Value     float64
+	Err       error
+}
+
+func (e *AppendError) Error() string {
+	return fmt.Sprintf("unable to append %s at %s: %v", e.Labels, timestamp.Time(e.Timestamp).UTC(), e.Err)
+}
+
+func (e *AppendError) Unwrap() error {
+	return e.Err
+}
+
+// FlushError is a block that can't be created, flushed or closed
+type FlushError struct {
+	Dir   string
+	Block ulid.ULID // Zero if the block was not created
+	Err   error
+}
+
+func (e *FlushError) Error() string {
+	if e.Block == (ulid.ULID{}) {
+		return fmt.Sprintf("unable to write a block in %s: %v", e.Dir, e.Err)
+	}
+	return fmt.Sprintf("unable to write block %s in %s: %v", e.Block, e.Dir, e.Err)
+}
+
+func (e *FlushError) Unwrap() error {
+	return e.Err
+}
+
+// CompactionError is a set of blocks that can't be compacted by the final compaction: they are left as they are
+type CompactionError struct {
+	Dir    string
+	Blocks []ulid.ULID
+	Err    error
+}
+
+func (e *CompactionError) Error() string {
+	return fmt.Sprintf("unable to compact the blocks %v in %s: %v", e.Blocks, e.Dir, e.Err)
+}
+
+func (e *CompactionError) Unwrap() error {
+	return e.Err
+}
+
+// SourceError is a source that can't be opened, read or closed
+type SourceError struct {
+	Source string // String() of the source if it is a fmt.Stringer, its position and type otherwise
+	Err    error
+}
+
+func (e *SourceError) Error() string {
+	return fmt.Sprintf("unable to read %s: %v", e.Source, e.Err)
+}
+
+func (e *SourceError) Unwrap() error {
+	return e.Err
+}
+
+// CancelError is returned by RunJob when its context is cancelled: the tables consumed before the cancellation are in
+// the flushed blocks
+type CancelError struct {
+	Progress Progress
+	Err      error // Error of the context
+}
+
+func (e *CancelError) Error() string {
+	return fmt.Sprintf("job cancelled after %d/%d tables, %d blocks written: %v", e.Progress.Tables,
+		e.Progress.Total, e.Progress.Blocks, e.Err)
+}
+
+func (e *CancelError) Unwrap() error {
+	return e.Err
+}
+
+// ErrorPolicy is how the job handles the errors of single rows and samples (SchemaError and AppendError)
+type ErrorPolicy string
+
+const (
+	ErrorFailFast ErrorPolicy = "fail-fast" // The first error makes the job fail
+	ErrorSkip     ErrorPolicy = "skip"      // Rows and samples in error are skipped and counted
+	ErrorCollect  ErrorPolicy = "collect"   // Errors are collected (see RowErrors) until a maximum, then the job fails
+)
+
+func (p ErrorPolicy) validate() error {
+	switch p {
+	case ErrorFailFast, ErrorSkip, ErrorCollect:
+		return nil
+	}
+	return fmt.Errorf("unknown error policy %s", p)
+}
+
+// rowError writes the row (nil for the errors of samples) to the dead-letter file and applies the error policy to its
+// error. It is thread-safe
+func (bh *Handler) rowError(err error, row interface{}) {
+	bh.deadLetter(err, row)
+	bh.rowErrorCount.Inc()
+	switch bh.errorPolicy {
+	case ErrorSkip:
+	case ErrorCollect:
+		bh.errorsLock.Lock()
+		collected := len(bh.rowErrors) < bh.maxRowErrors
+		if collected {
+			bh.rowErrors = append(bh.rowErrors, err)
+		}
+		bh.errorsLock.Unlock()
+		if !collected {
+			bh.fail(fmt.Errorf("%w: more than %d (last: %v)", ErrTooManyRowErrors, bh.maxRowErrors, err))
+		}
+	default: // ErrorFailFast
+		bh.fail(err)
+	}
+}
+
+// RowErrors returns the errors collected by the ErrorCollect policy
+func (bh *Handler) RowErrors() []error {
+	bh.errorsLock.Lock()
+	defer bh.errorsLock.Unlock()
+	return append([]error(nil), bh.rowErrors...)
+}
+
+// fail records the error and makes the job stop: the next tables are discarded and the job returns the error. It is
+// thread-safe
+func (bh *Handler) fail(err error) {
+	if bh.failed.CAS(false, true) {
+		Notice4("The job failed, discarding the next tables")
+	}
+	bh.reportError(err)
+}
+
+// err returns the first error of the job, if any
+func (bh *Handler) err() error {
+	errs := bh.Errors()
+	switch len(errs) {
+	case 0:
+		return nil
+	case 1:
+		return errs[0]
+	default:
+		return fmt.Errorf("%w (and %d more errors, see Errors)", errs[0], len(errs)-1)
+	}
+}
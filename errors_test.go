@@ -0,0 +1,98 @@
+package prometheus_backfill
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+type testRow struct {
+	Timestamp int64   // s
+	Usage     float64 `prometheus:"metric_type:gauge"`
+}
+
+// noName is a sample rejected by the handler
+func noName(t int64) Sample {
+	return Sample{Labels: map[string]string{"id": "a"}, Timestamp: t, Value: 1}
+}
+
+func TestErrorPolicies(t *testing.T) {
+	tables := []interface{}{
+		[]Sample{gauge("m", 1000, 1), noName(1000)},
+		[]Sample{noName(2000), gauge("m", 2000, 2)},
+	}
+	tests := []struct {
+		policy    ErrorPolicy
+		maxErrors int
+		fails     bool
+		collected int
+	}{
+		{ErrorFailFast, 0, true, 0},
+		{ErrorSkip, 0, false, 0},
+		{ErrorCollect, 0, false, 2}, // 1k by default
+		{ErrorCollect, 2, false, 2},
+		{ErrorCollect, 1, true, 1},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.policy), func(t *testing.T) {
+			dir := t.TempDir()
+			bh, err := runTestJob(t, Options{
+				OutputDir:           dir,
+				BlockDuration:       time.Hour,
+				MaxParallelConsumes: 1,
+				ErrorPolicy:         tt.policy,
+				MaxErrors:           tt.maxErrors,
+			}, tables...)
+			if tt.fails {
+				var schemaErr *SchemaError
+				if !errors.As(err, &schemaErr) && !errors.Is(err, ErrTooManyRowErrors) {
+					t.Fatalf("error %v, expected a row error", err)
+				}
+				if tt.policy == ErrorCollect && !errors.Is(err, ErrTooManyRowErrors) {
+					t.Errorf("error %v, expected too many row errors", err)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if n := len(bh.RowErrors()); n != tt.collected {
+				t.Errorf("%d errors collected, expected %d", n, tt.collected)
+			}
+			if tt.fails {
+				return
+			}
+			if bh.rowErrorCount.Load() != 2 {
+				t.Errorf("%d row errors, expected 2", bh.rowErrorCount.Load())
+			}
+			blocks := readTestBlocks(t, dir)
+			if len(blocks) != 1 || len(blocks[0].series[`{__name__="m"}`]) != 2 {
+				t.Errorf("blocks %+v, expected the 2 valid samples", blocks)
+			}
+		})
+	}
+}
+
+func TestNilTables(t *testing.T) {
+	dir := t.TempDir()
+	bh, err := runTestJob(t, Options{OutputDir: dir, BlockDuration: time.Hour, ErrorPolicy: ErrorCollect},
+		nil,
+		(*[]testRow)(nil),
+		[]*testRow{nil, {Timestamp: 1, Usage: 0.5}},
+		[]interface{}{nil},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rowErrors := bh.RowErrors()
+	if len(rowErrors) != 4 {
+		t.Fatalf("errors %v, expected 4", rowErrors)
+	}
+	for _, err := range rowErrors {
+		if !errors.As(err, new(*SchemaError)) {
+			t.Errorf("error %v, expected a schema error", err)
+		}
+	}
+	blocks := readTestBlocks(t, dir)
+	if len(blocks) != 1 || len(blocks[0].series[`{__name__="Usage"}`]) != 1 {
+		t.Errorf("blocks %+v, expected the valid row", blocks)
+	}
+}
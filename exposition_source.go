@@ -0,0 +1,186 @@
+package prometheus_backfill
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	labels2 "github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/pkg/textparse"
+	"github.com/prometheus/prometheus/pkg/timestamp"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+const defaultExpositionBatchSize = 10000
+
+// ExpositionFormat is the format of the exposition files
+type ExpositionFormat string
+
+const (
+	ExpositionAuto        ExpositionFormat = ""            // OpenMetrics if the file ends with # EOF, the text format otherwise
+	ExpositionText        ExpositionFormat = "text"        // The Prometheus text format
+	ExpositionOpenMetrics ExpositionFormat = "openmetrics" // OpenMetrics
+)
+
+// ExpositionOptions configures the sources of exposition files
+type ExpositionOptions struct {
+	Format ExpositionFormat
+	// Timestamp of the samples without one (the modification time of the file if zero)
+	DefaultTimestamp time.Time
+	BatchSize        int // Samples of each table (10k by default)
+}
+
+// MetricMetadata is the metadata of a metric family, from its HELP, TYPE and UNIT lines
+type MetricMetadata struct {
+	Type textparse.MetricType
+	Help string
+	Unit string
+}
+
+// ExpositionSource reads the samples of an exposition file (the Prometheus text format or OpenMetrics), optionally
+// gzipped (.gz), as promtool does. Samples of counters are stored as counters, the others as gauges
+type ExpositionSource struct {
+	path      string
+	opts      *ExpositionOptions
+	parser    textparse.Parser
+	metadata  map[string]MetricMetadata
+	defaultTs int64
+	exhausted bool // The OpenMetrics parser fails if it is called again after the end of the file
+}
+
+// ExpositionSources returns the sources of the exposition files matching the patterns (see filepath.Match; a
+// directory matches all the .prom, .txt and .om files below it, optionally gzipped)
+func ExpositionSources(opts ExpositionOptions, patterns ...string) ([]Source, error) {
+	switch opts.Format {
+	case ExpositionAuto, ExpositionText, ExpositionOpenMetrics:
+	default:
+		return nil, fmt.Errorf("invalid exposition options: unknown format %s", opts.Format)
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = defaultExpositionBatchSize
+	}
+	files, err := sourceFiles(patterns, ".prom", ".txt", ".om", ".prom.gz", ".txt.gz", ".om.gz")
+	if err != nil {
+		return nil, err
+	}
+	sources := make([]Source, 0, len(files))
+	for _, path := range files {
+		sources = append(sources, &ExpositionSource{path: path, opts: &opts})
+	}
+	return sources, nil
+}
+
+func (es *ExpositionSource) Open(context.Context) error {
+	f, err := openSourceFile(es.path)
+	if err != nil {
+		return err
+	}
+	b, err := ioutil.ReadAll(f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if es.opts.DefaultTimestamp.IsZero() {
+		info, err := os.Stat(es.path)
+		if err != nil {
+			return err
+		}
+		es.defaultTs = timestamp.FromTime(info.ModTime())
+	} else {
+		es.defaultTs = timestamp.FromTime(es.opts.DefaultTimestamp)
+	}
+	contentType := "text/plain"
+	if es.opts.Format == ExpositionOpenMetrics ||
+		es.opts.Format == ExpositionAuto && bytes.HasSuffix(bytes.TrimRight(b, "\n"), []byte("# EOF")) {
+		contentType = "application/openmetrics-text"
+	}
+	es.parser = textparse.New(b, contentType)
+	es.metadata = make(map[string]MetricMetadata)
+	return nil
+}
+
+// Next returns the next batch of samples
+func (es *ExpositionSource) Next(context.Context) (interface{}, error) {
+	var samples []Sample
+	for !es.exhausted && len(samples) < es.opts.BatchSize {
+		entry, err := es.parser.Next()
+		if errors.Is(err, io.EOF) {
+			es.exhausted = true
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch entry {
+		case textparse.EntryType:
+			name, typ := es.parser.Type()
+			m := es.metadata[string(name)]
+			m.Type = typ
+			es.metadata[string(name)] = m
+		case textparse.EntryHelp:
+			name, help := es.parser.Help()
+			m := es.metadata[string(name)]
+			m.Help = string(help)
+			es.metadata[string(name)] = m
+		case textparse.EntryUnit:
+			name, unit := es.parser.Unit()
+			m := es.metadata[string(name)]
+			m.Unit = string(unit)
+			es.metadata[string(name)] = m
+		case textparse.EntrySeries:
+			_, ts, v := es.parser.Series()
+			var lset labels2.Labels
+			es.parser.Metric(&lset)
+			s := Sample{Labels: lset.Map(), Timestamp: es.defaultTs, Value: v, Type: es.sampleType(lset.Get("__name__"))}
+			if ts != nil {
+				s.Timestamp = *ts
+			}
+			samples = append(samples, s)
+		}
+	}
+	if len(samples) == 0 {
+		return nil, io.EOF
+	}
+	return samples, nil
+}
+
+// sampleType returns the type of the samples of the series with the metric name
+func (es *ExpositionSource) sampleType(name string) string {
+	if m, ok := es.metadata[name]; ok { // The text format, or a counter without the _total suffix
+		if m.Type == textparse.MetricTypeCounter {
+			return "counter"
+		}
+		return "gauge"
+	}
+	if family := strings.TrimSuffix(name, "_total"); family != name { // OpenMetrics
+		if es.metadata[family].Type == textparse.MetricTypeCounter {
+			return "counter"
+		}
+	}
+	return "gauge"
+}
+
+// Metadata returns the metadata of the metric families of the file, by family name. It has to be called after the
+// source has been read (e.g. after RunSources)
+func (es *ExpositionSource) Metadata() map[string]MetricMetadata {
+	metadata := make(map[string]MetricMetadata, len(es.metadata))
+	for name, m := range es.metadata {
+		metadata[name] = m
+	}
+	return metadata
+}
+
+func (es *ExpositionSource) Close() error {
+	es.parser = nil // The content of the file is released
+	return nil
+}
+
+func (es *ExpositionSource) String() string {
+	return es.path
+}
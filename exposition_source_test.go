@@ -0,0 +1,127 @@
+package prometheus_backfill
+
+import (
+	"context"
+	"github.com/prometheus/prometheus/pkg/textparse"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// readExposition reads the samples of the exposition file with the content, by series
+func readExposition(t *testing.T, name, content string) (*ExpositionSource, map[string]Sample) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(path, []byte(content), 0666); err != nil {
+		t.Fatal(err)
+	}
+	// Small batches: the metadata and the end of the file span several calls of Next
+	sources, err := ExpositionSources(ExpositionOptions{DefaultTimestamp: time.Unix(100, 0), BatchSize: 3}, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	es := sources[0].(*ExpositionSource)
+	if err := es.Open(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer es.Close()
+	samples := make(map[string]Sample)
+	for {
+		table, err := es.Next(context.Background())
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, s := range table.([]Sample) {
+			samples[s.Labels["__name__"]+s.Labels["code"]] = s
+		}
+	}
+	return es, samples
+}
+
+func TestExpositionSampleType(t *testing.T) {
+	tests := []struct {
+		name, content string
+		types         map[string]string // Series => type
+		timestamps    map[string]int64
+	}{
+		{
+			name: "text.prom",
+			content: `# HELP requests_total Requests.
+# TYPE requests_total counter
+requests_total{code="200"} 10 1000
+requests_total{code="500"} 1
+# TYPE temperature gauge
+temperature 21.5 2000
+# TYPE restarts counter
+restarts 3
+untyped_metric 7
+`,
+			types: map[string]string{"requests_total200": "counter", "requests_total500": "counter",
+				"temperature": "gauge", "restarts": "counter", "untyped_metric": "gauge"},
+			timestamps: map[string]int64{"requests_total200": 1000, "requests_total500": 100000, "temperature": 2000},
+		},
+		{
+			name: "openmetrics.om",
+			content: `# TYPE requests counter
+# HELP requests Requests.
+requests_total{code="200"} 10 1.5
+requests_created{code="200"} 1
+# TYPE temperature gauge
+temperature 21.5
+# TYPE events_total gauge
+events_total 4
+# EOF
+`,
+			types: map[string]string{"requests_total200": "counter", "requests_created200": "gauge",
+				"temperature": "gauge", "events_total": "gauge"},
+			timestamps: map[string]int64{"requests_total200": 1500, "temperature": 100000},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, samples := readExposition(t, tt.name, tt.content)
+			if len(samples) != len(tt.types) {
+				t.Errorf("%d series, expected %d", len(samples), len(tt.types))
+			}
+			for series, typ := range tt.types {
+				if s, ok := samples[series]; !ok || s.Type != typ {
+					t.Errorf("series %s: %+v, expected a %s", series, s, typ)
+				}
+			}
+			for series, ts := range tt.timestamps {
+				if samples[series].Timestamp != ts {
+					t.Errorf("series %s at %d, expected %d", series, samples[series].Timestamp, ts)
+				}
+			}
+		})
+	}
+}
+
+func TestExpositionMetadata(t *testing.T) {
+	es, _ := readExposition(t, "metadata.om", `# TYPE requests counter
+# HELP requests Requests served.
+requests_total 10
+# TYPE temperature_celsius gauge
+# UNIT temperature_celsius celsius
+temperature_celsius 21.5
+# EOF
+`)
+	expected := map[string]MetricMetadata{
+		"requests":            {Type: textparse.MetricTypeCounter, Help: "Requests served."},
+		"temperature_celsius": {Type: textparse.MetricTypeGauge, Unit: "celsius"},
+	}
+	metadata := es.Metadata()
+	if len(metadata) != len(expected) {
+		t.Errorf("metadata %+v, expected %+v", metadata, expected)
+	}
+	for name, m := range expected {
+		if metadata[name] != m {
+			t.Errorf("metadata of %s: %+v, expected %+v", name, metadata[name], m)
+		}
+	}
+}
@@ -3,8 +3,6 @@ package prometheus_backfill
 import (
 	"context"
 	"fmt"
-	"github.com/prometheus/prometheus/storage"
-	"github.com/prometheus/prometheus/tsdb"
 	"go.uber.org/atomic"
 	"golang.org/x/sync/semaphore"
 	"math"
@@ -15,110 +13,273 @@ import (
 	"time"
 )
 
-type backfillHandler struct {
+// Handler converts the tables sent to its channel into Prometheus TSDB blocks. Create it with New
+type Handler struct {
 	ch                  chan interface{}
 	total               atomic.Int64
 	done                atomic.Int64
 	startTime           time.Time
-	appender            storage.Appender
-	blockWriter         *tsdb.BlockWriter
 	writerLock          sync.Locker
-	bstLock             sync.Locker
+	indexLock           sync.Locker
 	ctx                 context.Context
-	minTime             int64
-	counter             int64
-	bst                 *bst
+	index               *timeIndex
 	tmpWg               sync.WaitGroup // Temporary auxiliary waitGroup todo delete or give it a good usage
 	maxParallelConsumes int64
 	blockDuration       int64
 	maxPerAppender      int64
 	storeThreshold      int64
 	outputDir           string
+	aggregationRules    []*AggregationRule
+	aggregatedIn        atomic.Int64
+	aggregatedOut       atomic.Int64
+	duplicatePolicy     DuplicatePolicy
+	duplicates          map[string]int64 // Number of duplicate samples per metric name
+	duplicatesLock      sync.Mutex
+	spillDir            string   // Temporary directory of the sorted runs, if the external sort is enabled
+	runs                []string // Paths of the sorted runs spilled to disk
+	spillLock           sync.Mutex
+	streamingWriter     bool // Write blocks with the streamBlockWriter instead of tsdb.BlockWriter
+	writers             *writerPool
+	maxOpenWriters      int
+	maxTime             int64 // Maximum timestamp seen, for the watermark
+	allowedLateness     int64 // ms
+	latePolicy          LatePolicy
+	lateOutputDir       string
+	lateWriters         *writerPool
+	lateSamples         atomic.Int64
+	compactionRange     int64 // ms, the final compaction is disabled if 0
+	verifyBlocks        bool
+	atomicOutput        AtomicOutput
+	protectedRanges     []TimeRange // Sorted time ranges already covered by the target Prometheus data directory
+	protectedSamples    atomic.Int64
+	coveredRanges       map[string][]TimeRange // Metric name => sorted time ranges already imported
+	skippedSamples      atomic.Int64
+	errors              []error // Errors of the job
+	errorsLock          sync.Mutex
+	checkpoint          *checkpoint
+	errorPolicy         ErrorPolicy
+	maxRowErrors        int
+	rowErrors           []error // Row errors collected by the ErrorCollect policy
+	rowErrorCount       atomic.Int64
+	failed              atomic.Bool
+	deadLetters         *os.File
+	deadLettersLock     sync.Mutex
+	deadLetterCount     atomic.Int64
+	cancelled           atomic.Bool
+	offsets             map[string]int64 // Last offset received from each source
+	tablesAfterOffset   map[string]bool  // Producers that sent tables after their last offset
+	maxParallelSources  int64
 }
 
-func NewPrometheusBackfillHandler(blockDuration, maxPerAppender, storeThreshold,
-	maxParallelConsumes int64, ch chan interface{}, total int64, outputDir string) *backfillHandler {
-	// make(chan interface{}, bufferedChanCap)
-	bh := &backfillHandler{
-		ch,
-		atomic.Int64{},
-		atomic.Int64{},
-		time.Now(),
-		nil,
-		nil,
-		&sync.Mutex{},
-		&sync.Mutex{},
-		context.Background(),
-		math.MaxInt64, 0,
-		new(bst),
-		sync.WaitGroup{},
-		maxParallelConsumes,
-		blockDuration,
-		maxPerAppender,
-		storeThreshold,
-		outputDir,
-	}
-	bh.total.Store(total)
-	return bh
+// Progress is the progress of a job
+type Progress struct {
+	Tables int64 // Tables consumed
+	Total  int64 // Tables expected
+	Blocks int   // Blocks written
+	// Offsets of the tables in the written blocks (see SourceOffset): the last offset received from each source, or the
+	// ones of the last checkpoint if checkpointing is enabled
+	Offsets    map[string]int64
+	Duplicates map[string]int64 // Duplicate samples found per metric name (see Options.DuplicatePolicy)
 }
 
-func (bh *backfillHandler) RunJob() {
+// RunJob consumes the tables sent to the channel until it is closed, and writes them into blocks. It returns the first
+// error of the job (see Errors, and Options.ErrorPolicy for the errors of single rows and samples). After an error, the
+// next tables are discarded.
+// When ctx is cancelled, the job stops consuming the channel (producers should stop sending on ctx.Done() too),
+// stores the in-flight tables, flushes the open blocks and returns a *CancelError with the progress of the job. With
+// checkpointing, a last checkpoint is taken if no producer sent tables after its last SourceOffset (the blocks then
+// hold exactly the tables before the offsets, see ProducerTable). The compaction is skipped, and the blocks of the atomic job output are
+// left in the staging directory.
+func (bh *Handler) RunJob(ctx context.Context) error {
 	Notice("main", "Start parsing database")
+	bh.ctx = ctx
 	bh.done.Store(0)
-	go bh.statusLoop()
+	stop := make(chan struct{})
+	go bh.statusLoop(stop)
 	bh.listenOnChannel()
 	bh.tmpWg.Wait()
+	close(stop)
 	Notice("main", "End of parsing")
+	if err := bh.err(); err != nil {
+		return err
+	}
+	if bh.cancelled.Load() {
+		return &CancelError{Progress: bh.Progress(), Err: ctx.Err()}
+	}
+	return nil
 }
 
-func (bh *backfillHandler) listenOnChannel() {
+// Progress returns the progress of the job
+func (bh *Handler) Progress() Progress {
+	p := Progress{
+		Tables:  bh.done.Load(),
+		Total:   bh.total.Load(),
+		Offsets: make(map[string]int64),
+	}
+	bh.writerLock.Lock()
+	for _, pool := range []*writerPool{bh.writers, bh.lateWriters} {
+		if pool != nil {
+			p.Blocks += len(pool.flushed)
+		}
+	}
+	offsets := bh.offsets
+	if bh.checkpoint != nil {
+		offsets = bh.checkpoint.Offsets
+	}
+	for source, offset := range offsets {
+		p.Offsets[source] = offset
+	}
+	bh.writerLock.Unlock()
+	p.Duplicates = make(map[string]int64)
+	bh.duplicatesLock.Lock()
+	for metricName, n := range bh.duplicates {
+		p.Duplicates[metricName] = n
+	}
+	bh.duplicatesLock.Unlock()
+	return p
+}
+
+func (bh *Handler) listenOnChannel() {
 	Notice("Listening on channel")
-	bh.setBlockWriter()
+	var err error
+	if bh.writers, err = bh.newWriterPool(bh.outputDir); err != nil {
+		bh.fail(err)
+	} else if _, ok := bh.checkpoint.poolOf(bh.lateOutputDir); ok && bh.latePolicy == LateSeparate {
+		// Resumes the late blocks of the checkpoint
+		if bh.lateWriters, err = bh.newWriterPool(bh.lateOutputDir); err != nil {
+			bh.fail(err)
+		}
+	}
 	sem := semaphore.NewWeighted(bh.maxParallelConsumes)
 	var counter atomic.Int64
-	for msg := range bh.ch {
+	for msg := range bh.messages() {
+		producer := ""
+		if pt, ok := msg.(ProducerTable); ok {
+			producer, msg = pt.Producer, pt.Table
+		}
+		if bh.failed.Load() {
+			bh.done.Inc() // Drains the channel, so that producers don't block
+			bh.ack(msg)
+			continue
+		}
+		if offset, ok := msg.(SourceOffset); ok {
+			bh.writerLock.Lock()
+			bh.offsets[offset.Source] = offset.Offset
+			bh.writerLock.Unlock()
+			delete(bh.tablesAfterOffset, producer)
+			bh.checkpointOffset(sem, offset)
+			continue
+		}
 		table := msg
-		sem.Acquire(bh.ctx, 1)
+		bh.tablesAfterOffset[producer] = true
+		// The semaphore is acquired with no deadline: in-flight tables are always stored, even if the job is cancelled
+		_ = sem.Acquire(context.Background(), 1)
 		go func() {
 			bh.checkAndStore(false)
 			_ = counter.Inc()
 			t := time.Now().UnixNano()
 			bh.marshal(table)
+			bh.ack(table)
 			t = (time.Now().UnixNano() - t) / int64(time.Millisecond)
 			// Notice("Marshaled", i, "(", reflect.TypeOf(table).String(), ") in", t, "ms. Status:", bh.done.Load(), "/", bh.total.Load())
 			bh.done.Inc()
 			sem.Release(1)
 		}()
 	}
-	sem.Acquire(bh.ctx, bh.maxParallelConsumes)
+	_ = sem.Acquire(context.Background(), bh.maxParallelConsumes)
 	bh.checkAndStore(true)
 
-
 	bh.writerLock.Lock()
-	bh.flushBlockWriter()
+	for _, p := range []*writerPool{bh.writers, bh.lateWriters} {
+		if p == nil {
+			continue
+		}
+		bh.closePool(p)
+	}
+	if bh.checkpoint != nil && len(bh.Errors()) == 0 {
+		var err error
+		switch {
+		case !bh.cancelled.Load():
+			err = bh.checkpoint.finish(bh.writers, bh.lateWriters)
+		case len(bh.tablesAfterOffset) == 0:
+			err = bh.checkpoint.commit(bh.writers, bh.lateWriters)
+		}
+		if err != nil {
+			bh.fail(err)
+		}
+	}
 	bh.writerLock.Unlock()
+	bh.closeDeadLetters()
+	if bh.spillDir != "" {
+		if err := os.RemoveAll(bh.spillDir); err != nil {
+			ErrLog("Error removing the spill directory %s: %v\n", bh.spillDir, err)
+		}
+	}
 }
 
-func (bh *backfillHandler) statusLoop() {
+// ack acknowledges the table to its producer, if it waits for it (see ackedTable)
+func (bh *Handler) ack(table interface{}) {
+	t, ok := table.(ackedTable)
+	switch {
+	case !ok:
+	case bh.failed.Load(): // The tables are discarded
+		t.ack(bh.err())
+	default:
+		t.ack(nil)
+	}
+}
+
+// messages returns the channel of the tables, closed when the channel of the producers is closed or the job is
+// cancelled
+func (bh *Handler) messages() <-chan interface{} {
+	out := make(chan interface{})
+	go func() {
+		defer close(out)
+		for {
+			select {
+			case <-bh.ctx.Done():
+				bh.cancelled.Store(true)
+				Notice4("The job has been cancelled, storing the in-flight tables")
+				return
+			case msg, ok := <-bh.ch:
+				if !ok {
+					return
+				}
+				out <- msg
+			}
+		}
+	}()
+	return out
+}
+
+func (bh *Handler) statusLoop(stop <-chan struct{}) {
 	w := tabwriter.NewWriter(os.Stdout, 1, 2, 5, ' ', tabwriter.DiscardEmptyColumns)
 	mem := runtime.MemStats{}
 	for {
 		if bh.PrintStats(w, mem) {
 			return
 		}
-		time.Sleep(time.Second * 10)
+		select {
+		case <-stop:
+			return
+		case <-time.After(time.Second * 10):
+		}
 	}
 }
 
-func (bh *backfillHandler) PrintStats(w *tabwriter.Writer, mem runtime.MemStats) (endOfJob bool) {
+func (bh *Handler) PrintStats(w *tabwriter.Writer, mem runtime.MemStats) (endOfJob bool) {
 	done := bh.done.Load()
 	total := bh.total.Load()
 	now := time.Now()
-	fmt.Fprintln(w,"Progress\tProgress (%)\tRapidity\tStart time\tCurrent Time\tDuration")
+	fmt.Fprintln(w, "Progress\tProgress (%)\tRapidity\tStart time\tCurrent Time\tDuration")
+	progress := math.NaN() // The number of tables is unknown
+	if total > 0 {
+		progress = float64(done) / float64(total) * 100
+	}
 	fmt.Fprintf(w, "%d/%d\t%.2f%%\t%.2f tables/s\t%s\t%s\t%s\n",
 		done,
 		total,
-		float64(done)/float64(total)*100,
+		progress,
 		float64(done)/now.Sub(bh.startTime).Seconds(),
 		bh.startTime.Format(time.RFC3339),
 		now.Format(time.RFC3339),
@@ -128,8 +289,34 @@ func (bh *backfillHandler) PrintStats(w *tabwriter.Writer, mem runtime.MemStats)
 	fmt.Fprintf(w, "mem.TotalAlloc:\t%E\n", float64(mem.TotalAlloc))
 	fmt.Fprintf(w, "mem.HeapAlloc:\t%E\n", float64(mem.HeapAlloc))
 	fmt.Fprintf(w, "mem.NumGC:\t%E\n", float64(mem.NumGC))
+	if len(bh.aggregationRules) > 0 {
+		fmt.Fprintf(w, "Aggregated samples (in/out):\t%d/%d\n", bh.aggregatedIn.Load(), bh.aggregatedOut.Load())
+	}
+	if bh.latePolicy != "" {
+		fmt.Fprintf(w, "Late samples (%s):\t%d\n", bh.latePolicy, bh.lateSamples.Load())
+	}
+	if len(bh.protectedRanges) > 0 {
+		fmt.Fprintf(w, "Samples in protected ranges:\t%d\n", bh.protectedSamples.Load())
+	}
+	if bh.coveredRanges != nil {
+		fmt.Fprintf(w, "Samples already imported:\t%d\n", bh.skippedSamples.Load())
+	}
+	if n := bh.rowErrorCount.Load(); n > 0 {
+		fmt.Fprintf(w, "Rows and samples in error (%s):\t%d\n", bh.errorPolicy, n)
+	}
+	if n := bh.deadLetterCount.Load(); n > 0 {
+		fmt.Fprintf(w, "Dead letters:\t%d\n", n)
+	}
+	if errs := bh.Errors(); len(errs) > 0 {
+		fmt.Fprintf(w, "Errors:\t%d\n", len(errs))
+	}
+	bh.duplicatesLock.Lock()
+	for metricName, n := range bh.duplicates {
+		fmt.Fprintf(w, "Duplicate samples (%s):\t%d\n", metricName, n)
+	}
+	bh.duplicatesLock.Unlock()
 	w.Flush()
-	if done == total {
+	if total > 0 && done == total {
 		return true
 	}
 	return false
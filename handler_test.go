@@ -0,0 +1,48 @@
+package prometheus_backfill
+
+import (
+	"testing"
+	"time"
+)
+
+func TestInvalidOptions(t *testing.T) {
+	tests := []struct {
+		name string
+		opts Options
+	}{
+		{"block duration", Options{BlockDuration: time.Microsecond}},
+		{"duplicate policy", Options{DuplicatePolicy: "first"}},
+		{"error policy", Options{ErrorPolicy: "ignore"}},
+		{"negative max errors", Options{ErrorPolicy: ErrorCollect, MaxErrors: -1}},
+		{"late policy", Options{LatePolicy: "keep"}},
+		{"lateness without a late policy", Options{AllowedLateness: time.Minute}},
+		{"negative lateness", Options{LatePolicy: LateDrop, AllowedLateness: -time.Minute}},
+		{"compaction range", Options{CompactionRange: time.Microsecond}},
+		{"atomic output", Options{AtomicOutput: "all"}},
+		{"aggregation op", Options{AggregationRules: []AggregationRule{{Op: AggregateSum}, {Op: "min"}}}},
+		{"checkpoint interval without a path", Options{CheckpointInterval: time.Minute}},
+		{"external sort directory", Options{ExternalSortDir: "/tmp"}},
+		{"incremental directory", Options{IncrementalDir: "/tmp"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.opts.OutputDir = t.TempDir()
+			if _, err := New(nil, tt.opts); err == nil {
+				t.Fatal("invalid options accepted")
+			}
+		})
+	}
+}
+
+func TestNewPrometheusBackfillHandler(t *testing.T) {
+	bh := NewPrometheusBackfillHandler(0, 0, 0, 0, make(chan interface{}), 0, t.TempDir())
+	if bh == nil {
+		t.Fatal("no handler with the default options")
+	}
+	if bh.blockDuration != int64(defaultBlockDuration/time.Millisecond) || bh.maxPerAppender != defaultMaxSamplesPerAppender {
+		t.Errorf("block duration %d and max samples %d, expected the defaults", bh.blockDuration, bh.maxPerAppender)
+	}
+	if NewPrometheusBackfillHandler(-1, 0, 0, 0, make(chan interface{}), 0, t.TempDir()) != nil {
+		t.Error("handler with a negative block duration")
+	}
+}
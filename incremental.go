@@ -0,0 +1,101 @@
+package prometheus_backfill
+
+import (
+	"fmt"
+	"github.com/go-kit/kit/log"
+	labels2 "github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/tsdb"
+	"github.com/prometheus/prometheus/tsdb/chunks"
+	"math"
+)
+
+// setIncremental scans the blocks of dir to work out the time ranges covered by each metric
+func (bh *Handler) setIncremental(dir string) error {
+	if dir == "" {
+		dir = bh.outputDir
+	}
+	covered, err := coveredRangesByMetric(dir)
+	if err != nil {
+		return fmt.Errorf("unable to scan the blocks of %s: %w", dir, err)
+	}
+	bh.coveredRanges = covered
+	Notice3("Incremental backfill:", len(covered), "metrics already imported in", dir)
+	return nil
+}
+
+// coveredRangesByMetric returns the sorted time ranges covered by each metric in the blocks of dir
+func coveredRangesByMetric(dir string) (map[string][]TimeRange, error) {
+	blocks, err := readBlocks(dir)
+	if err != nil {
+		return nil, err
+	}
+	ranges := make(map[string][]TimeRange)
+	for _, b := range blocks {
+		if err := blockRangesByMetric(b.Dir, ranges); err != nil {
+			return nil, err
+		}
+	}
+	for name, r := range ranges {
+		ranges[name] = mergeTimeRanges(r)
+	}
+	return ranges, nil
+}
+
+// blockRangesByMetric adds to ranges the time range covered by each metric of the block in dir
+func blockRangesByMetric(dir string, ranges map[string][]TimeRange) error {
+	b, err := tsdb.OpenBlock(log.NewNopLogger(), dir, nil)
+	if err != nil {
+		return err
+	}
+	defer b.Close()
+	ir, err := b.Index()
+	if err != nil {
+		return err
+	}
+	defer ir.Close()
+	names, err := ir.LabelValues(labels2.MetricName)
+	if err != nil {
+		return err
+	}
+	var (
+		lset labels2.Labels
+		chks []chunks.Meta
+	)
+	for _, name := range names {
+		p, err := ir.Postings(labels2.MetricName, name)
+		if err != nil {
+			return err
+		}
+		r := TimeRange{MinTime: math.MaxInt64, MaxTime: math.MinInt64}
+		for p.Next() {
+			if err := ir.Series(p.At(), &lset, &chks); err != nil {
+				return err
+			}
+			for _, c := range chks {
+				if c.MinTime < r.MinTime {
+					r.MinTime = c.MinTime
+				}
+				if c.MaxTime+1 > r.MaxTime { // Ranges are half-open
+					r.MaxTime = c.MaxTime + 1
+				}
+			}
+		}
+		if err := p.Err(); err != nil {
+			return err
+		}
+		if r.MinTime < r.MaxTime {
+			name = string([]byte(name)) // The index strings are mmap-ed: copy them before closing the block
+			ranges[name] = append(ranges[name], r)
+		}
+	}
+	return nil
+}
+
+// isCovered tells whether the sample has already been imported, for the incremental backfill
+func (bh *Handler) isCovered(labels []labels2.Label, t int64) bool {
+	if len(bh.coveredRanges) == 0 {
+		return false
+	}
+	ranges, ok := bh.coveredRanges[labels2.Labels(labels).Get(labels2.MetricName)]
+	return ok && timeRangesContain(ranges, t)
+}
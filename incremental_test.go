@@ -0,0 +1,43 @@
+package prometheus_backfill
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIncrementalSkipsCoveredRanges(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := runTestJob(t, Options{OutputDir: dir, BlockDuration: time.Hour},
+		[]Sample{gauge("m", 1000, 1), gauge("m", 3000, 3)}); err != nil {
+		t.Fatal(err)
+	}
+	// Re-run with the samples already imported, and new ones
+	bh, err := runTestJob(t, Options{OutputDir: dir, BlockDuration: time.Hour, Incremental: true},
+		[]Sample{gauge("m", 1000, 1), gauge("m", 2000, 2), gauge("m", 3000, 3), gauge("m", 4000, 4),
+			gauge("n", 2000, 2)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := bh.skippedSamples.Load(); n != 3 {
+		t.Errorf("%d samples skipped, expected 3", n)
+	}
+	blocks := readTestBlocks(t, dir)
+	if len(blocks) != 2 {
+		t.Fatalf("%d blocks, expected 2", len(blocks))
+	}
+	series := make(map[string][]testSample)
+	for _, b := range blocks {
+		for s, samples := range b.series {
+			series[s] = append(series[s], samples...)
+		}
+	}
+	expected := map[string][]testSample{
+		`{__name__="m"}`: {{1000, 1}, {3000, 3}, {4000, 4}},
+		`{__name__="n"}`: {{2000, 2}},
+	}
+	for s, samples := range expected {
+		if !equalTestSamples(series[s], samples) {
+			t.Errorf("samples of %s: %v, expected %v", s, series[s], samples)
+		}
+	}
+}
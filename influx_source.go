@@ -0,0 +1,308 @@
+package prometheus_backfill
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/prometheus/prometheus/pkg/timestamp"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultInfluxBatchSize = 1000
+
+// InfluxOptions configures the sources of InfluxDB line protocol files. Each field of a line is a sample of the
+// metric measurement_field, with the tags as labels (invalid characters of the names are replaced by '_'). Boolean
+// fields are 1 or 0, string fields are skipped
+type InfluxOptions struct {
+	Precision string // Precision of the timestamps: ns (the default), us, ms or s
+	// Metric name (measurement_field) => counter or gauge (the default). The names of the counters end with _total, as
+	// for the prometheus tags
+	Types map[string]string
+	// Timestamp of the lines without one (the modification time of the file if zero)
+	DefaultTimestamp time.Time
+	BatchSize        int // Lines of each table (1k by default)
+}
+
+// InfluxSource reads an InfluxDB line protocol file, optionally gzipped (.gz), e.g. as written by Telegraf
+type InfluxSource struct {
+	path      string
+	opts      *InfluxOptions
+	file      io.ReadCloser
+	scanner   *bufio.Scanner
+	line      int
+	defaultTs int64
+}
+
+// InfluxSources returns the sources of the line protocol files matching the patterns (see filepath.Match; a directory
+// matches all the .lp, .line and .influx files below it, optionally gzipped)
+func InfluxSources(opts InfluxOptions, patterns ...string) ([]Source, error) {
+	switch opts.Precision {
+	case "", "ns", "us", "ms", "s":
+	default:
+		return nil, fmt.Errorf("invalid influx options: unknown precision %s", opts.Precision)
+	}
+	for name, typ := range opts.Types {
+		switch typ {
+		case "counter", "gauge":
+		default:
+			return nil, fmt.Errorf("invalid influx options: unknown metric type %s of %s", typ, name)
+		}
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = defaultInfluxBatchSize
+	}
+	files, err := sourceFiles(patterns, ".lp", ".line", ".influx", ".lp.gz", ".line.gz", ".influx.gz")
+	if err != nil {
+		return nil, err
+	}
+	sources := make([]Source, 0, len(files))
+	for _, path := range files {
+		sources = append(sources, &InfluxSource{path: path, opts: &opts})
+	}
+	return sources, nil
+}
+
+func (is *InfluxSource) Open(context.Context) error {
+	var err error
+	if is.opts.DefaultTimestamp.IsZero() {
+		info, err := os.Stat(is.path)
+		if err != nil {
+			return err
+		}
+		is.defaultTs = timestamp.FromTime(info.ModTime())
+	} else {
+		is.defaultTs = timestamp.FromTime(is.opts.DefaultTimestamp)
+	}
+	if is.file, err = openSourceFile(is.path); err != nil {
+		return err
+	}
+	is.scanner = bufio.NewScanner(is.file)
+	is.scanner.Buffer(nil, 1<<24)
+	return nil
+}
+
+// Next returns the next batch of lines, converted into samples by the handler
+func (is *InfluxSource) Next(context.Context) (interface{}, error) {
+	table := &influxTable{source: is}
+	for len(table.lines) < is.opts.BatchSize && is.scanner.Scan() {
+		is.line++
+		line := strings.TrimSpace(is.scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		table.lines = append(table.lines, line)
+		table.numbers = append(table.numbers, is.line)
+	}
+	if err := is.scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(table.lines) == 0 {
+		return nil, io.EOF
+	}
+	return table, nil
+}
+
+func (is *InfluxSource) Close() error {
+	return is.file.Close()
+}
+
+func (is *InfluxSource) String() string {
+	return is.path
+}
+
+// influxTable is a batch of lines of a line protocol file
+type influxTable struct {
+	source  *InfluxSource
+	lines   []string
+	numbers []int // Line numbers
+}
+
+func (t *influxTable) samples(reject func(err error, row interface{})) []Sample {
+	opts := t.source.opts
+	samples := make([]Sample, 0, len(t.lines))
+	for i, line := range t.lines {
+		p, err := parseInfluxLine(line)
+		if err != nil {
+			reject(&SchemaError{Type: t.source.path, Reason: fmt.Sprintf("line %d: %v", t.numbers[i], err)}, line)
+			continue
+		}
+		ts := t.source.defaultTs
+		if p.timestamp != nil {
+			ts = influxTimestamp(*p.timestamp, opts.Precision)
+		}
+		labels := make(map[string]string, len(p.tags)+1)
+		for k, v := range p.tags {
+			labels[sanitizeName(k, false)] = v
+		}
+		for _, f := range p.fields {
+			if f.isString {
+				continue
+			}
+			name := sanitizeName(p.measurement+"_"+f.key, true)
+			typ := opts.Types[name]
+			if typ == "counter" && !strings.HasSuffix(name, "_total") {
+				name += "_total"
+			}
+			s := Sample{Labels: make(map[string]string, len(labels)+1), Timestamp: ts, Value: f.value, Type: typ}
+			for k, v := range labels {
+				s.Labels[k] = v
+			}
+			s.Labels["__name__"] = name
+			samples = append(samples, s)
+		}
+	}
+	return samples
+}
+
+// influxTimestamp converts the timestamp with the precision into ms
+func influxTimestamp(ts int64, precision string) int64 {
+	switch precision {
+	case "s":
+		return ts * 1000
+	case "ms":
+		return ts
+	case "us":
+		return ts / 1e3
+	default: // ns
+		return ts / 1e6
+	}
+}
+
+// influxPoint is a line of the line protocol
+type influxPoint struct {
+	measurement string
+	tags        map[string]string
+	fields      []influxField
+	timestamp   *int64
+}
+
+type influxField struct {
+	key      string
+	value    float64
+	isString bool
+}
+
+// parseInfluxLine parses a line of the line protocol: measurement[,tag=value...] field=value[,field=value...] [timestamp]
+func parseInfluxLine(line string) (*influxPoint, error) {
+	key, rest, ok := influxCut(line, ' ', false)
+	if !ok {
+		return nil, errors.New("no fields")
+	}
+	fields, ts, _ := influxCut(strings.TrimLeft(rest, " "), ' ', true)
+	measurement, tags, _ := influxCut(key, ',', false)
+	if measurement == "" {
+		return nil, errors.New("no measurement")
+	}
+	p := &influxPoint{measurement: influxUnescape(measurement), tags: make(map[string]string)}
+	for tags != "" {
+		var tag string
+		tag, tags, _ = influxCut(tags, ',', false)
+		k, v, ok := influxCut(tag, '=', false)
+		if !ok || k == "" {
+			return nil, fmt.Errorf("invalid tag %q", tag)
+		}
+		p.tags[influxUnescape(k)] = influxUnescape(v)
+	}
+	for fields != "" {
+		var field string
+		field, fields, _ = influxCut(fields, ',', true)
+		k, v, ok := influxCut(field, '=', true)
+		if !ok || k == "" || v == "" {
+			return nil, fmt.Errorf("invalid field %q", field)
+		}
+		f, err := parseInfluxValue(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value of field %s: %w", k, err)
+		}
+		f.key = influxUnescape(k)
+		p.fields = append(p.fields, f)
+	}
+	if len(p.fields) == 0 {
+		return nil, errors.New("no fields")
+	}
+	if ts = strings.TrimSpace(ts); ts != "" {
+		t, err := strconv.ParseInt(ts, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timestamp %q", ts)
+		}
+		p.timestamp = &t
+	}
+	return p, nil
+}
+
+func parseInfluxValue(v string) (influxField, error) {
+	switch v {
+	case "t", "T", "true", "True", "TRUE":
+		return influxField{value: 1}, nil
+	case "f", "F", "false", "False", "FALSE":
+		return influxField{value: 0}, nil
+	}
+	switch v[len(v)-1] {
+	case '"':
+		if len(v) < 2 || v[0] != '"' {
+			return influxField{}, errors.New("unterminated string")
+		}
+		return influxField{isString: true}, nil
+	case 'i':
+		i, err := strconv.ParseInt(v[:len(v)-1], 10, 64)
+		return influxField{value: float64(i)}, err
+	case 'u':
+		u, err := strconv.ParseUint(v[:len(v)-1], 10, 64)
+		return influxField{value: float64(u)}, err
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	return influxField{value: f}, err
+}
+
+// influxCut cuts s around the first unescaped sep, outside of the double-quoted strings if quotes is true
+func influxCut(s string, sep byte, quotes bool) (before, after string, found bool) {
+	quoted := false
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\':
+			i++
+		case quotes && s[i] == '"':
+			quoted = !quoted
+		case !quoted && s[i] == sep:
+			return s[:i], s[i+1:], true
+		}
+	}
+	return s, "", false
+}
+
+// influxUnescape removes the backslashes escaping commas, equal signs, spaces, quotes and backslashes
+func influxUnescape(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) && strings.IndexByte(`,= "\`, s[i+1]) >= 0 {
+			i++
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// sanitizeName replaces the characters that are invalid in a metric name (or in a label name, without the colons)
+// with '_', and prefixes the names starting with a digit with '_'
+func sanitizeName(s string, colons bool) string {
+	if s != "" && s[0] >= '0' && s[0] <= '9' {
+		s = "_" + s
+	}
+	b := []byte(s)
+	for i, c := range b {
+		valid := c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+			colons && c == ':'
+		if !valid {
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
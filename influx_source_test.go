@@ -0,0 +1,102 @@
+package prometheus_backfill
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseInfluxLine(t *testing.T) {
+	ts := func(t int64) *int64 { return &t }
+	tests := []struct {
+		line  string
+		point *influxPoint // nil if the line is invalid
+	}{
+		{
+			line: "cpu,host=a,region=eu usage=0.5,idle=99 1600000000000000000",
+			point: &influxPoint{measurement: "cpu", tags: map[string]string{"host": "a", "region": "eu"},
+				fields: []influxField{{key: "usage", value: 0.5}, {key: "idle", value: 99}}, timestamp: ts(1600000000000000000)},
+		},
+		{
+			line:  "cpu usage=1",
+			point: &influxPoint{measurement: "cpu", tags: map[string]string{}, fields: []influxField{{key: "usage", value: 1}}},
+		},
+		{
+			line: "cpu  usage=1   -1000",
+			point: &influxPoint{measurement: "cpu", tags: map[string]string{}, fields: []influxField{{key: "usage", value: 1}},
+				timestamp: ts(-1000)},
+		},
+		{
+			line: `my\ cpu,host\,name=a\ b,k\=ey=v\=al us\ age=1`,
+			point: &influxPoint{measurement: "my cpu", tags: map[string]string{"host,name": "a b", "k=ey": "v=al"},
+				fields: []influxField{{key: "us age", value: 1}}},
+		},
+		{
+			line: `log,host=a msg="a, \"quoted\" string=1 2",level=3i 1000`,
+			point: &influxPoint{measurement: "log", tags: map[string]string{"host": "a"},
+				fields: []influxField{{key: "msg", isString: true}, {key: "level", value: 3}}, timestamp: ts(1000)},
+		},
+		{
+			line: "disk used=-42i,total=18446744073709551615u,ratio=1e-3",
+			point: &influxPoint{measurement: "disk", tags: map[string]string{}, fields: []influxField{
+				{key: "used", value: -42}, {key: "total", value: 18446744073709551615}, {key: "ratio", value: 0.001}}},
+		},
+		{
+			line: "up a=t,b=T,c=true,d=True,e=TRUE,f=f,g=F,h=false,i=False,j=FALSE",
+			point: &influxPoint{measurement: "up", tags: map[string]string{}, fields: []influxField{
+				{key: "a", value: 1}, {key: "b", value: 1}, {key: "c", value: 1}, {key: "d", value: 1},
+				{key: "e", value: 1}, {key: "f"}, {key: "g"}, {key: "h"}, {key: "i"}, {key: "j"}}},
+		},
+		{line: "cpu"},                      // No fields
+		{line: "cpu "},                     // No fields
+		{line: ",host=a usage=1"},          // No measurement
+		{line: "cpu,host usage=1"},         // Tag without a value
+		{line: "cpu,=a usage=1"},           // Tag without a key
+		{line: "cpu usage"},                // Field without a value
+		{line: "cpu usage="},               // Field without a value
+		{line: "cpu =1"},                   // Field without a key
+		{line: "cpu usage=abc"},            // Invalid float
+		{line: "cpu usage=1.5i"},           // Invalid integer
+		{line: "cpu usage=-1u"},            // Invalid unsigned integer
+		{line: `cpu msg="unterminated`},    // Unterminated string
+		{line: `cpu msg="`},                // Unterminated string
+		{line: "cpu usage=1 1600000000.5"}, // Invalid timestamp
+	}
+	for _, tt := range tests {
+		t.Run(tt.line, func(t *testing.T) {
+			p, err := parseInfluxLine(tt.line)
+			if tt.point == nil {
+				if err == nil {
+					t.Fatalf("invalid line parsed into %+v", p)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(p, tt.point) {
+				t.Errorf("point %+v, expected %+v", p, tt.point)
+			}
+		})
+	}
+}
+
+func TestInfluxTimestamp(t *testing.T) {
+	tests := []struct {
+		ts        int64
+		precision string
+		ms        int64
+	}{
+		{1600000000123456789, "", 1600000000123},
+		{1600000000123456789, "ns", 1600000000123},
+		{1600000000123456, "us", 1600000000123},
+		{1600000000123, "ms", 1600000000123},
+		{1600000000, "s", 1600000000000},
+		{-1000000, "ns", -1},
+		{0, "s", 0},
+	}
+	for _, tt := range tests {
+		if ms := influxTimestamp(tt.ts, tt.precision); ms != tt.ms {
+			t.Errorf("%d with precision %q: %d ms, expected %d", tt.ts, tt.precision, ms, tt.ms)
+		}
+	}
+}
@@ -4,134 +4,67 @@ import (
 	io_prometheus_client "github.com/prometheus/client_model/go"
 	"reflect"
 	"regexp"
-	"strings"
 	"sync"
 )
 
 // [CONCUR] Rows are parsed concurrently
-func (bh *backfillHandler) marshal(table interface{}) {
+func (bh *Handler) marshal(table interface{}) {
+	switch t := table.(type) {
+	case []DeadLetter:
+		bh.replay(t)
+		return
+	case []Sample:
+		bh.insertSamples(t)
+		return
+	case rawTable:
+		bh.insertSamples(t.samples(bh.rowError))
+		return
+	}
 	list := reflect.ValueOf(table)
-	if list.Kind() == reflect.Ptr {
+	if list.Kind() == reflect.Ptr && !list.IsNil() {
 		list = list.Elem()
 	}
-	if list.Kind() != reflect.Slice {
+	switch {
+	case !list.IsValid():
+		bh.rowError(&SchemaError{Type: "nil", Reason: "the table is nil"}, nil)
+		return
+	case list.Kind() == reflect.Ptr: // A nil pointer
+		bh.rowError(&SchemaError{Type: list.Type().String(), Reason: "the table is nil"}, nil)
+		return
+	case list.Kind() != reflect.Slice:
 		// TODO Handle not list model
-		panic("It's not a list. Implement me")
+		bh.rowError(&SchemaError{Type: list.Type().String(), Reason: "the table is not a list"}, table)
+		return
 	}
 
 	wg := sync.WaitGroup{}
 	for i := 0; i < list.Len(); i++ { // Concurrent rows insertion
 		structValue := reflect.ValueOf(list.Index(i).Interface())
-		structType := reflect.TypeOf(list.Index(i).Interface())
 		wg.Add(1)
 		go func() {
-			if structValue.Kind() == reflect.Ptr {
+			defer wg.Done()
+			if structValue.Kind() == reflect.Ptr && !structValue.IsNil() {
 				structValue = structValue.Elem()
 			}
-			if structType.Kind() == reflect.Ptr {
-				structType = structType.Elem()
+			if !structValue.IsValid() || structValue.Kind() == reflect.Ptr { // A nil row
+				bh.rowError(&SchemaError{Type: list.Type().Elem().String(), Reason: "the row is nil"}, nil)
+				return
+			}
+			s, err := bh.schemaFor(structValue.Type()) // Compiled on the first row of each type
+			if err != nil {
+				bh.rowError(err, structValue.Interface())
+				return
 			}
-			GetAdditionalLabels := structValue.MethodByName("GetAdditionalLabels")
-			timestamp := structValue.FieldByName("Timestamp").Int() * 1000 // See expfmt/openmetrics_create.go:348
-			var row []*io_prometheus_client.Metric                         // same time stamp
-			bh.deepReflectParse(timestamp, structType, structValue, GetAdditionalLabels, &row)
-			bh.bstLock.Lock()
-			bh.bst.insert(row)
-			bh.bstLock.Unlock()
-			wg.Done()
+			row := bh.convertRow(s, structValue) // same time stamp
+			bh.indexLock.Lock()
+			bh.index.insert(row)
+			bh.indexLock.Unlock()
 		}()
 	}
 	wg.Wait()
 }
 
-// deepReflectParse, finally, inserts a metric into the bst
-func (bh *backfillHandler) deepReflectParse(timestamp int64, structType reflect.Type,
-	structValue reflect.Value, GetAdditionalLabels reflect.Value, row *[]*io_prometheus_client.Metric) {
-	for i := 0; i < structType.NumField(); i++ { // columns
-		st := structType.Field(i)
-		field := structValue.Field(i)
-		switch field.Kind() {
-		case reflect.Struct:
-			bh.deepReflectParse(timestamp, reflect.TypeOf(field.Interface()), field, GetAdditionalLabels, row)
-		case reflect.Float64:
-			metric := bh.makeMetric(st, field.Float(), &timestamp, GetAdditionalLabels)
-			if metric != nil {
-				*row = append(*row, metric)
-			}
-		case reflect.Int64:
-			metric := bh.makeMetric(st, float64(field.Int()), &timestamp, GetAdditionalLabels)
-			if metric != nil {
-				*row = append(*row, metric)
-			}
-		default:
-		}
-	}
-}
-
-func (bh *backfillHandler) makeMetric(st reflect.StructField, metricValue float64,
-	ts *int64, GetAdditionalLabels reflect.Value) (metric *io_prometheus_client.Metric) {
-
-	metricName := st.Name
-	metricLabels := bh.getPrometheusLabels(st.Tag.Get("prometheus"))
-	if bh.isMetricNameValid(metricLabels["metric_name"]) {
-		metricName = metricLabels["metric_name"]
-	}
-	if len(metricLabels) == 0 {
-		return nil
-	}
-	metric = new(io_prometheus_client.Metric)
-	if !reflect.ValueOf(GetAdditionalLabels).IsZero() {
-		mapp := GetAdditionalLabels.Call([]reflect.Value{})[0].MapRange()
-		for mapp.Next() {
-			k := mapp.Key()
-			v := mapp.Value()
-			metricLabels[k.String()] = v.String()
-		}
-	}
-
-	metricType, ok := metricLabels["metric_type"]
-	if !ok || metricType == "-" { // Ignore unwanted metrics
-		return
-	}
-	var _ io_prometheus_client.MetricType // MetricType
-	switch metricType {
-	case "counter": // TODO
-		_ = io_prometheus_client.MetricType_COUNTER
-		if !strings.HasSuffix(metricName, "_total") {
-			// expfmt.MetricFamiliyToOpenMetric row 91
-			metricName += "_total"
-		}
-		metric.Counter = &io_prometheus_client.Counter{
-			Value: &metricValue,
-		}
-	case "gauge":
-		_ = io_prometheus_client.MetricType_GAUGE
-		metric.Gauge = &io_prometheus_client.Gauge{
-			Value: &metricValue,
-		}
-	case "histogram": // TODO
-		_ = io_prometheus_client.MetricType_HISTOGRAM
-		panic("implement me")
-	case "summary": // TODO
-		_ = io_prometheus_client.MetricType_SUMMARY
-		panic("implement me")
-	default: // TODO
-		_ = io_prometheus_client.MetricType_UNTYPED
-		panic("implement me")
-	}
-	var metricHelp = new(string)
-	*metricHelp, ok = metricLabels["help"]
-	if !ok {
-		metricHelp = nil
-	}
-	delete(metricLabels, "metric_type")
-	metricLabels["__name__"] = metricName
-	metric.Label = bh.marshalLabelsMap(metricLabels)
-	metric.TimestampMs = ts
-	return
-}
-
-func (*backfillHandler) marshalLabelsMap(labels map[string]string) (prometheusLabels []*io_prometheus_client.LabelPair) {
+func (*Handler) marshalLabelsMap(labels map[string]string) (prometheusLabels []*io_prometheus_client.LabelPair) {
 	for k, v := range labels {
 		name := k
 		value := v
@@ -143,7 +76,7 @@ func (*backfillHandler) marshalLabelsMap(labels map[string]string) (prometheusLa
 	return
 }
 
-func (*backfillHandler) isMetricNameValid(metricName string) bool {
+func (*Handler) isMetricNameValid(metricName string) bool {
 	if match, _ := regexp.MatchString("[a-zA-Z_:][a-zA-Z0-9_:]*", metricName); !match || metricName == "" {
 		return false
 	}
@@ -151,7 +84,7 @@ func (*backfillHandler) isMetricNameValid(metricName string) bool {
 }
 
 // E.g. prometheus:"metric_type:counter,unit:W,myLabel1:myLabel1Value..."
-func (*backfillHandler) getPrometheusLabels(tag string) (labels map[string]string) {
+func (*Handler) getPrometheusLabels(tag string) (labels map[string]string) {
 	labels = make(map[string]string)
 	for tag != "" {
 		// Skip leading space.
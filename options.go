@@ -0,0 +1,290 @@
+package prometheus_backfill
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"runtime"
+	"sync"
+	"time"
+)
+
+const (
+	defaultBlockDuration         = 2 * time.Hour // As the Prometheus head
+	defaultMaxSamplesPerAppender = int64(10e6)
+	defaultStoreThreshold        = int64(1e3)
+	defaultMaxErrors             = 1000
+)
+
+// Options configures a Handler. Zero values select the defaults, and leave the optional stages of the job disabled.
+type Options struct {
+	OutputDir     string        // Directory of the output blocks (required)
+	BlockDuration time.Duration // Range of the output blocks, aligned to its multiples (2h by default)
+	// Samples kept in memory for the block ranges before spilling the ones of the least recently used range to disk
+	// (10M by default): it bounds the memory used by the writers
+	MaxSamplesPerAppender int64
+	// Rows kept in the time index before storing them (1k by default): the index is locked while swapping it, so keep
+	// it small
+	StoreThreshold      int64
+	MaxParallelConsumes int64 // Tables marshaled in parallel (the number of CPUs by default)
+	MaxOpenBlockWriters int   // Block ranges with samples in memory at the same time (4 by default)
+	Tables              int64 // Tables that will be sent to the channel, for the progress stats (0 if unknown)
+	MaxParallelSources  int64 // Sources read at the same time by RunSources (4 by default)
+
+	// Pre-aggregation rules: each metric is aggregated by the first rule matching its name when the block of its range
+	// is written, so the groups span all the tables of the job. Metrics not matching any rule are stored as they are
+	AggregationRules []AggregationRule
+	// Policy resolving the duplicate samples of a block range, whatever table or batch they come from
+	// (DuplicateKeepFirst by default)
+	DuplicatePolicy DuplicatePolicy
+	// Policy for the errors of single rows and samples (ErrorFailFast by default). Other errors (e.g. FlushError)
+	// always make the job fail
+	ErrorPolicy ErrorPolicy
+	MaxErrors   int // Errors collected by ErrorCollect (1k by default)
+	// Late-data policy, disabled if empty: samples older than the watermark (the maximum timestamp seen minus
+	// AllowedLateness) are dropped, written into a separate set of blocks in LateOutputDir (OutputDir/late if empty) or
+	// make the job fail. It makes the layout of the output blocks predictable when producers read the sources in
+	// parallel, and lets the job write the block of a range as soon as the watermark passes its end
+	LatePolicy      LatePolicy
+	AllowedLateness time.Duration
+	LateOutputDir   string
+	// Range of the final compaction, disabled if 0: at the end of the job, the blocks it produced are merged by the tsdb
+	// LeveledCompactor into blocks of this range (aligned to its multiples), so that Prometheus doesn't have to compact
+	// many small or overlapping blocks on its first start. Each compacted block is verified before deleting the original
+	// ones, blocks spanning more than the range are left as they are. Failures are errors of the job (*CompactionError)
+	CompactionRange time.Duration
+	// Write the blocks into a staging directory (.staging inside the output one) and move them into place only when each
+	// block (AtomicOutputBlock) or the whole job (AtomicOutputJob) succeeds. The staging directory of a failed job is
+	// removed (kept to resume the job with a checkpoint), or cleaned up by the next run after a crash
+	AtomicOutput AtomicOutput
+	// File checkpointing the job, disabled if empty. If the file exists, the job resumes from it: the blocks flushed
+	// after its last checkpoint are deleted, the committed ones are kept (and compacted or moved into place with the new
+	// ones) and ResumeOffset returns the offsets the producers have to restart from. A checkpoint is taken at the first
+	// SourceOffset received after each CheckpointInterval with no producer having sent tables after its last offset (see
+	// ProducerTable): the in-flight tables are stored and the open block writers
+	// are flushed, so that the committed blocks contain exactly the tables before the offsets. Short intervals produce
+	// more and smaller blocks (see CompactionRange). A job interrupted during the final compaction has to be restarted
+	// without the checkpoint
+	CheckpointPath     string
+	CheckpointInterval time.Duration
+	// File the rejected samples and the rows that can't be converted into samples are appended to, as JSON lines of
+	// DeadLetter, whatever the error policy is (disabled if empty). The samples can be fixed and replayed by sending them
+	// back to the handler as a []DeadLetter table (see ReadDeadLetters); rows have to be unmarshaled into their type and
+	// sent back as usual
+	DeadLetterPath string
+	// External merge-sort mode: the rows sorted in the time index are spilled to temporary sorted run files in a new
+	// directory inside ExternalSortDir (os.TempDir() if empty) instead of being appended. At the end of the job (and at
+	// each checkpoint) the runs are merged in time order into the blocks, so the memory used for sorting stays bounded by
+	// the StoreThreshold whatever the size and the ordering of the input are
+	ExternalSort    bool
+	ExternalSortDir string
+	// Write the blocks without the in-memory tsdb head (see streamBlockWriter): the memory used by a block is then
+	// proportional to the number of its series instead of the number of its samples
+	StreamingBlockWriter bool
+	// Skip the samples already imported: the blocks in IncrementalDir (OutputDir if empty) are scanned to work out the
+	// time range covered by each metric in each block, and the incoming samples of a metric falling into its covered
+	// ranges are dropped and counted. Re-running an import on the same output is then idempotent
+	Incremental    bool
+	IncrementalDir string
+	// Prometheus data directory whose blocks and head (from the oldest sample of its wal) the output blocks must not
+	// overlap: the samples falling into their time ranges are refused and counted (disabled if empty)
+	ProtectedDataDir string
+	// Reopen each flushed block to check its series count, sample count and time range against what was appended, and
+	// the integrity of its index. Mismatches are errors of the job (see Errors), and the blocks are removed
+	VerifyBlocks bool
+}
+
+// withDefaults returns the options with the defaults in place of the zero values
+func (o Options) withDefaults() Options {
+	if o.BlockDuration == 0 {
+		o.BlockDuration = defaultBlockDuration
+	}
+	if o.MaxSamplesPerAppender == 0 {
+		o.MaxSamplesPerAppender = defaultMaxSamplesPerAppender
+	}
+	if o.StoreThreshold == 0 {
+		o.StoreThreshold = defaultStoreThreshold
+	}
+	if o.MaxParallelConsumes == 0 {
+		o.MaxParallelConsumes = int64(runtime.NumCPU())
+	}
+	if o.MaxOpenBlockWriters == 0 {
+		o.MaxOpenBlockWriters = defaultMaxOpenBlockWriters
+	}
+	if o.MaxParallelSources == 0 {
+		o.MaxParallelSources = defaultMaxParallelSources
+	}
+	if o.DuplicatePolicy == "" {
+		o.DuplicatePolicy = DuplicateKeepFirst
+	}
+	if o.ErrorPolicy == "" {
+		o.ErrorPolicy = ErrorFailFast
+	}
+	if o.MaxErrors == 0 {
+		o.MaxErrors = defaultMaxErrors
+	}
+	return o
+}
+
+func (o Options) validate() error {
+	switch {
+	case o.OutputDir == "":
+		return errors.New("invalid options: the output directory is required")
+	case o.BlockDuration < time.Millisecond || o.BlockDuration%time.Millisecond != 0:
+		return fmt.Errorf("invalid options: block duration %s is not a positive number of ms", o.BlockDuration)
+	case o.MaxSamplesPerAppender < 0:
+		return fmt.Errorf("invalid options: negative max samples per appender %d", o.MaxSamplesPerAppender)
+	case o.StoreThreshold < 0:
+		return fmt.Errorf("invalid options: negative store threshold %d", o.StoreThreshold)
+	case o.MaxParallelConsumes < 0:
+		return fmt.Errorf("invalid options: negative max parallel consumes %d", o.MaxParallelConsumes)
+	case o.MaxOpenBlockWriters < 0:
+		return fmt.Errorf("invalid options: negative max open block writers %d", o.MaxOpenBlockWriters)
+	case o.Tables < 0:
+		return fmt.Errorf("invalid options: negative number of tables %d", o.Tables)
+	case o.MaxParallelSources < 0:
+		return fmt.Errorf("invalid options: negative max parallel sources %d", o.MaxParallelSources)
+	case o.MaxErrors < 0:
+		return fmt.Errorf("invalid options: negative max errors %d", o.MaxErrors)
+	case o.LatePolicy == "" && (o.AllowedLateness != 0 || o.LateOutputDir != ""):
+		return errors.New("invalid options: allowed lateness or late output directory without a late policy")
+	case o.AllowedLateness < 0:
+		return fmt.Errorf("invalid options: negative allowed lateness %s", o.AllowedLateness)
+	case o.CompactionRange < 0 || o.CompactionRange%time.Millisecond != 0:
+		return fmt.Errorf("invalid options: compaction range %s is not a positive number of ms", o.CompactionRange)
+	case o.CheckpointPath == "" && o.CheckpointInterval != 0:
+		return errors.New("invalid options: checkpoint interval without a checkpoint path")
+	case o.CheckpointInterval < 0:
+		return fmt.Errorf("invalid options: negative checkpoint interval %s", o.CheckpointInterval)
+	case !o.ExternalSort && o.ExternalSortDir != "":
+		return errors.New("invalid options: external sort directory without the external sort")
+	case !o.Incremental && o.IncrementalDir != "":
+		return errors.New("invalid options: incremental directory without the incremental mode")
+	}
+	for i := range o.AggregationRules {
+		if err := o.AggregationRules[i].validate(); err != nil {
+			return fmt.Errorf("invalid options: %w", err)
+		}
+	}
+	for _, err := range []error{o.DuplicatePolicy.validate(), o.ErrorPolicy.validate(), o.AtomicOutput.validate()} {
+		if err != nil {
+			return fmt.Errorf("invalid options: %w", err)
+		}
+	}
+	if o.LatePolicy != "" {
+		if err := o.LatePolicy.validate(); err != nil {
+			return fmt.Errorf("invalid options: %w", err)
+		}
+	}
+	return nil
+}
+
+// New creates a Handler writing the tables sent to ch into blocks. ch can be nil if the tables are read from
+// sources (see RunSources)
+func New(ch chan interface{}, opts Options) (*Handler, error) {
+	opts = opts.withDefaults()
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	if ch == nil {
+		ch = make(chan interface{}, opts.MaxParallelConsumes)
+	}
+	bh := newHandler(ch, opts)
+	if err := bh.open(opts); err != nil {
+		return nil, err
+	}
+	return bh, nil
+}
+
+// NewPrometheusBackfillHandler creates a Handler with blockDuration in ms, as New does: zero values select the defaults.
+// It logs the error and returns nil if the options are invalid.
+//
+// Deprecated: use New, which returns the error of invalid options.
+func NewPrometheusBackfillHandler(blockDuration, maxPerAppender, storeThreshold,
+	maxParallelConsumes int64, ch chan interface{}, total int64, outputDir string) *Handler {
+	bh, err := New(ch, Options{
+		OutputDir:             outputDir,
+		BlockDuration:         time.Duration(blockDuration) * time.Millisecond,
+		MaxSamplesPerAppender: maxPerAppender,
+		StoreThreshold:        storeThreshold,
+		MaxParallelConsumes:   maxParallelConsumes,
+		Tables:                total,
+	})
+	if err != nil {
+		ErrLog("Unable to create the handler: %v\n", err)
+		return nil
+	}
+	return bh
+}
+
+func newHandler(ch chan interface{}, opts Options) *Handler {
+	bh := &Handler{
+		ch:                  ch,
+		startTime:           time.Now(),
+		writerLock:          &sync.Mutex{},
+		indexLock:           &sync.Mutex{},
+		ctx:                 context.Background(),
+		index:               newTimeIndex(),
+		maxParallelConsumes: opts.MaxParallelConsumes,
+		blockDuration:       int64(opts.BlockDuration / time.Millisecond),
+		maxPerAppender:      opts.MaxSamplesPerAppender,
+		storeThreshold:      opts.StoreThreshold,
+		outputDir:           opts.OutputDir,
+		duplicatePolicy:     opts.DuplicatePolicy,
+		maxOpenWriters:      opts.MaxOpenBlockWriters,
+		maxParallelSources:  opts.MaxParallelSources,
+		maxTime:             math.MinInt64,
+		errorPolicy:         opts.ErrorPolicy,
+		maxRowErrors:        opts.MaxErrors,
+		compactionRange:     int64(opts.CompactionRange / time.Millisecond),
+		atomicOutput:        opts.AtomicOutput,
+		streamingWriter:     opts.StreamingBlockWriter,
+		verifyBlocks:        opts.VerifyBlocks,
+		offsets:             make(map[string]int64),
+		tablesAfterOffset:   make(map[string]bool),
+	}
+	for _, r := range opts.AggregationRules {
+		r := r
+		bh.aggregationRules = append(bh.aggregationRules, &r)
+	}
+	if opts.LatePolicy != "" {
+		bh.setWatermark(opts.AllowedLateness, opts.LatePolicy, opts.LateOutputDir)
+	}
+	bh.total.Store(opts.Tables)
+	return bh
+}
+
+// open sets the stages of the job reading or creating files up
+func (bh *Handler) open(opts Options) error {
+	if opts.Incremental {
+		if err := bh.setIncremental(opts.IncrementalDir); err != nil {
+			return err
+		}
+	}
+	if opts.ProtectedDataDir != "" {
+		if err := bh.setProtectedDataDir(opts.ProtectedDataDir); err != nil {
+			return err
+		}
+	}
+	if opts.CheckpointPath != "" {
+		if err := bh.setCheckpoint(opts.CheckpointPath, opts.CheckpointInterval); err != nil {
+			return err
+		}
+	}
+	if opts.ExternalSort {
+		if err := bh.setExternalSort(opts.ExternalSortDir); err != nil {
+			return err
+		}
+	}
+	if opts.DeadLetterPath != "" {
+		if err := bh.setDeadLetter(opts.DeadLetterPath); err != nil {
+			if bh.spillDir != "" {
+				_ = os.RemoveAll(bh.spillDir)
+			}
+			return err
+		}
+	}
+	return nil
+}
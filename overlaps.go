@@ -0,0 +1,284 @@
+package prometheus_backfill
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/oklog/ulid"
+	"github.com/prometheus/prometheus/pkg/timestamp"
+	"github.com/prometheus/prometheus/tsdb"
+	"github.com/prometheus/prometheus/tsdb/record"
+	"github.com/prometheus/prometheus/tsdb/wal"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// TimeRange is a half-open [MinTime, MaxTime) range in ms, as for the blocks
+type TimeRange struct {
+	MinTime int64
+	MaxTime int64
+}
+
+func (r TimeRange) String() string {
+	return fmt.Sprintf("[%s, %s)", timestamp.Time(r.MinTime).UTC().Format(time.RFC3339),
+		timestamp.Time(r.MaxTime).UTC().Format(time.RFC3339))
+}
+
+func (r TimeRange) overlaps(o TimeRange) bool {
+	return r.MinTime < o.MaxTime && o.MinTime < r.MaxTime
+}
+
+// BlockInfo is a block found in a TSDB directory
+type BlockInfo struct {
+	ULID string
+	Dir  string
+	TimeRange
+}
+
+// Overlap is a block of the backfill output overlapping a block of the Prometheus data directory, or its head if
+// Existing.ULID is "head"
+type Overlap struct {
+	Block    BlockInfo
+	Existing BlockInfo
+}
+
+// OverlapReport is the result of CheckOverlaps
+type OverlapReport struct {
+	Blocks              []BlockInfo // Blocks of the output directory
+	Existing            []BlockInfo // Blocks of the Prometheus data directory, and its head if any
+	Overlaps            []Overlap
+	Gaps                []TimeRange // Ranges not covered by any block between the first and the last one
+	RetentionViolations []BlockInfo // Blocks of the output directory that Prometheus would delete by retention
+}
+
+// OK tells whether the output blocks can be moved into the Prometheus data directory
+func (r *OverlapReport) OK() bool {
+	return len(r.Overlaps) == 0 && len(r.RetentionViolations) == 0
+}
+
+func (r *OverlapReport) Print(w io.Writer) {
+	fmt.Fprintf(w, "Output blocks: %d, existing blocks: %d\n", len(r.Blocks), len(r.Existing))
+	for _, o := range r.Overlaps {
+		fmt.Fprintf(w, "OVERLAP: block %s %s overlaps %s %s\n", o.Block.ULID, o.Block.TimeRange, o.Existing.ULID,
+			o.Existing.TimeRange)
+	}
+	for _, g := range r.Gaps {
+		fmt.Fprintf(w, "GAP: %s\n", g)
+	}
+	for _, b := range r.RetentionViolations {
+		fmt.Fprintf(w, "RETENTION: block %s %s is beyond the retention\n", b.ULID, b.TimeRange)
+	}
+}
+
+// headULID is the name used for the head of the Prometheus data directory in the reports
+const headULID = "head"
+
+// CheckOverlaps reads the meta.json files of the blocks in outputDir and in the Prometheus dataDir and reports the
+// output blocks overlapping the existing blocks or the head, the gaps in the time ranges covered by them and the
+// output blocks that Prometheus would delete because of the retention (if retention is not 0).
+// The head covers the time from the oldest sample of the wal of dataDir up to now.
+func CheckOverlaps(outputDir, dataDir string, retention time.Duration) (*OverlapReport, error) {
+	blocks, err := readBlocks(outputDir)
+	if err != nil {
+		return nil, err
+	}
+	existing, err := readDataDirRanges(dataDir)
+	if err != nil {
+		return nil, err
+	}
+	report := &OverlapReport{
+		Blocks:   blocks,
+		Existing: existing,
+	}
+	for _, b := range blocks {
+		for _, e := range existing {
+			if b.overlaps(e.TimeRange) {
+				report.Overlaps = append(report.Overlaps, Overlap{Block: b, Existing: e})
+			}
+		}
+	}
+
+	var all []TimeRange
+	for _, b := range append(append([]BlockInfo(nil), blocks...), existing...) {
+		all = append(all, b.TimeRange)
+	}
+	covered := mergeTimeRanges(all)
+	for i := 1; i < len(covered); i++ {
+		report.Gaps = append(report.Gaps, TimeRange{MinTime: covered[i-1].MaxTime, MaxTime: covered[i].MinTime})
+	}
+
+	if retention > 0 && len(covered) > 0 {
+		// Prometheus deletes the blocks ending more than the retention before the newest one
+		newest := covered[len(covered)-1].MaxTime
+		for _, b := range blocks {
+			if newest-b.MaxTime > int64(retention/time.Millisecond) {
+				report.RetentionViolations = append(report.RetentionViolations, b)
+			}
+		}
+	}
+	return report, nil
+}
+
+// readDataDirRanges returns the blocks of a Prometheus data directory and its head, if it has samples
+func readDataDirRanges(dataDir string) ([]BlockInfo, error) {
+	existing, err := readBlocks(dataDir)
+	if err != nil {
+		return nil, err
+	}
+	walDir := filepath.Join(dataDir, "wal")
+	if _, err := os.Stat(walDir); err != nil {
+		return existing, nil
+	}
+	head, ok, err := readHeadRange(walDir)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the head of %s: %w", dataDir, err)
+	}
+	if ok {
+		existing = append(existing, BlockInfo{ULID: headULID, Dir: walDir, TimeRange: head})
+	}
+	return existing, nil
+}
+
+// readHeadRange returns the range of the head of a Prometheus data directory: from the oldest sample of its wal (and
+// of its last checkpoint) up to now, as the head keeps receiving samples. It returns false if the wal has no samples.
+func readHeadRange(walDir string) (TimeRange, bool, error) {
+	var segments []io.ReadCloser
+	defer func() {
+		for _, s := range segments {
+			_ = s.Close()
+		}
+	}()
+	checkpoint, _, err := wal.LastCheckpoint(walDir)
+	switch {
+	case err == nil:
+		s, err := wal.NewSegmentsReader(checkpoint)
+		if err != nil {
+			return TimeRange{}, false, err
+		}
+		segments = append(segments, s)
+	case !errors.Is(err, record.ErrNotFound):
+		return TimeRange{}, false, err
+	}
+	s, err := wal.NewSegmentsReader(walDir)
+	if err != nil {
+		return TimeRange{}, false, err
+	}
+	segments = append(segments, s)
+
+	head := TimeRange{MinTime: math.MaxInt64, MaxTime: math.MinInt64}
+	var (
+		dec     record.Decoder
+		samples []record.RefSample
+	)
+	for _, s := range segments {
+		r := wal.NewReader(s)
+		for r.Next() {
+			rec := r.Record()
+			if dec.Type(rec) != record.Samples {
+				continue
+			}
+			if samples, err = dec.Samples(rec, samples[:0]); err != nil {
+				return TimeRange{}, false, err
+			}
+			for _, sample := range samples {
+				if sample.T < head.MinTime {
+					head.MinTime = sample.T
+				}
+				if sample.T >= head.MaxTime {
+					head.MaxTime = sample.T + 1
+				}
+			}
+		}
+		if err := r.Err(); err != nil {
+			return TimeRange{}, false, err
+		}
+	}
+	if head.MinTime == math.MaxInt64 {
+		return TimeRange{}, false, nil
+	}
+	if now := timestamp.FromTime(time.Now()); now > head.MaxTime {
+		head.MaxTime = now
+	}
+	return head, true, nil
+}
+
+// readBlocks reads the meta.json files of the blocks in dir, sorted by time
+func readBlocks(dir string) ([]BlockInfo, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var blocks []BlockInfo
+	for _, f := range files {
+		if _, err := ulid.ParseStrict(f.Name()); !f.IsDir() || err != nil {
+			continue
+		}
+		blockDir := filepath.Join(dir, f.Name())
+		b, err := ioutil.ReadFile(filepath.Join(blockDir, "meta.json"))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		var meta tsdb.BlockMeta
+		if err := json.Unmarshal(b, &meta); err != nil {
+			return nil, fmt.Errorf("reading the meta of block %s: %w", blockDir, err)
+		}
+		blocks = append(blocks, BlockInfo{
+			ULID:      meta.ULID.String(),
+			Dir:       blockDir,
+			TimeRange: TimeRange{MinTime: meta.MinTime, MaxTime: meta.MaxTime},
+		})
+	}
+	sort.Slice(blocks, func(i, j int) bool {
+		return blocks[i].MinTime < blocks[j].MinTime
+	})
+	return blocks, nil
+}
+
+// mergeTimeRanges returns the sorted union of the ranges
+func mergeTimeRanges(ranges []TimeRange) []TimeRange {
+	ranges = append([]TimeRange(nil), ranges...)
+	sort.Slice(ranges, func(i, j int) bool {
+		return ranges[i].MinTime < ranges[j].MinTime
+	})
+	var merged []TimeRange
+	for _, r := range ranges {
+		if n := len(merged); n > 0 && r.MinTime <= merged[n-1].MaxTime {
+			if r.MaxTime > merged[n-1].MaxTime {
+				merged[n-1].MaxTime = r.MaxTime
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+// timeRangesContain tells whether t is in the sorted union of ranges
+func timeRangesContain(ranges []TimeRange, t int64) bool {
+	i := sort.Search(len(ranges), func(i int) bool {
+		return ranges[i].MaxTime > t
+	})
+	return i < len(ranges) && ranges[i].MinTime <= t
+}
+
+// setProtectedDataDir reads the time ranges covered by the blocks and the head of dataDir
+func (bh *Handler) setProtectedDataDir(dataDir string) error {
+	existing, err := readDataDirRanges(dataDir)
+	if err != nil {
+		return fmt.Errorf("unable to read the blocks of %s: %w", dataDir, err)
+	}
+	var ranges []TimeRange
+	for _, b := range existing {
+		ranges = append(ranges, b.TimeRange)
+	}
+	bh.protectedRanges = mergeTimeRanges(ranges)
+	return nil
+}
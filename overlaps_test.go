@@ -0,0 +1,147 @@
+package prometheus_backfill
+
+import (
+	"fmt"
+	"github.com/go-kit/kit/log"
+	labels2 "github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/pkg/timestamp"
+	"github.com/prometheus/prometheus/tsdb"
+	"github.com/prometheus/prometheus/tsdb/record"
+	"github.com/prometheus/prometheus/tsdb/wal"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestWAL writes a wal in dataDir with a sample at each of the timestamps
+func writeTestWAL(t *testing.T, dataDir string, timestamps ...int64) {
+	t.Helper()
+	w, err := wal.New(nil, nil, filepath.Join(dataDir, "wal"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var enc record.Encoder
+	series := enc.Series([]record.RefSeries{{Ref: 1, Labels: labels2.FromStrings("__name__", "up")}}, nil)
+	if err := w.Log(series); err != nil {
+		t.Fatal(err)
+	}
+	for _, ts := range timestamps {
+		if err := w.Log(enc.Samples([]record.RefSample{{Ref: 1, T: ts, V: 1}}, nil)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCheckOverlapsHead(t *testing.T) {
+	outputDir := t.TempDir()
+	bw, err := tsdb.NewBlockWriter(log.NewNopLogger(), outputDir, 2*3600*1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestBlock(t, bw, map[string]int{"m": 10}) // [0, 10s), in 1970
+	hourAgo := timestamp.FromTime(time.Now().Add(-time.Hour))
+
+	tests := []struct {
+		name       string
+		timestamps []int64 // Samples of the wal, no wal if nil
+		head       bool
+		overlaps   int
+	}{
+		{"no wal", nil, false, 0},
+		{"empty wal", []int64{}, false, 0},
+		{"recent head", []int64{hourAgo + 1000, hourAgo}, true, 0},
+		{"head covering the block", []int64{hourAgo, 5000}, true, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dataDir := t.TempDir()
+			if tt.timestamps != nil {
+				writeTestWAL(t, dataDir, tt.timestamps...)
+			}
+			report, err := CheckOverlaps(outputDir, dataDir, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if head := len(report.Existing) == 1; head != tt.head {
+				t.Fatalf("existing %v, expected a head: %t", report.Existing, tt.head)
+			}
+			if tt.head {
+				head := report.Existing[0]
+				minTime := tt.timestamps[len(tt.timestamps)-1]
+				if head.ULID != headULID || head.MinTime != minTime || head.MaxTime < hourAgo+1001 {
+					t.Errorf("head %s %s, expected from %d", head.ULID, head.TimeRange, minTime)
+				}
+			}
+			if len(report.Overlaps) != tt.overlaps {
+				t.Errorf("overlaps %v, expected %d", report.Overlaps, tt.overlaps)
+			}
+		})
+	}
+}
+
+func TestProtectedDataDir(t *testing.T) {
+	dataDir := t.TempDir()
+	writeTestWAL(t, dataDir, 5000, 6000)
+	bh, err := New(nil, Options{OutputDir: t.TempDir(), ProtectedDataDir: dataDir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ts, protected := range map[int64]bool{1000: false, 4999: false, 5000: true, 6000: true} {
+		if timeRangesContain(bh.protectedRanges, ts) != protected {
+			t.Errorf("sample at %d protected: %t, expected %t", ts, !protected, protected)
+		}
+	}
+}
+
+// dirFiles returns the size and the modification time of the files below dir
+func dirFiles(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	files := make(map[string]string)
+	if err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		files[path] = fmt.Sprint(info.Size(), info.ModTime())
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestProtectedDataDirJob(t *testing.T) {
+	dataDir, outputDir := t.TempDir(), t.TempDir()
+	bw, err := tsdb.NewBlockWriter(log.NewNopLogger(), dataDir, 2*3600*1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestBlock(t, bw, map[string]int{"m": 10}) // [0, 10s)
+	writeTestWAL(t, dataDir, 50000, 60000)
+	before := dirFiles(t, dataDir)
+	bh, err := runTestJob(t, Options{OutputDir: outputDir, BlockDuration: time.Hour, ProtectedDataDir: dataDir},
+		[]Sample{gauge("m", 1000, 1), gauge("m", 20000, 2), gauge("m", 50000, 3), gauge("up", 70000, 4)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := bh.protectedSamples.Load(); n != 3 {
+		t.Errorf("%d protected samples, expected 3", n)
+	}
+	blocks := readTestBlocks(t, outputDir)
+	if len(blocks) != 1 || len(blocks[0].series) != 1 ||
+		!equalTestSamples(blocks[0].series[`{__name__="m"}`], []testSample{{20000, 2}}) {
+		t.Errorf("blocks %+v, expected only the sample out of the protected ranges", blocks)
+	}
+	after := dirFiles(t, dataDir)
+	if len(after) != len(before) {
+		t.Errorf("files of the protected directory %v, expected %v", after, before)
+	}
+	for path, f := range before {
+		if after[path] != f {
+			t.Errorf("%s of the protected directory changed", path)
+		}
+	}
+}
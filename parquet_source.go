@@ -0,0 +1,171 @@
+package prometheus_backfill
+
+import (
+	"context"
+	"fmt"
+	"github.com/xitongsys/parquet-go-source/local"
+	"github.com/xitongsys/parquet-go/common"
+	"github.com/xitongsys/parquet-go/reader"
+	"github.com/xitongsys/parquet-go/source"
+	"io"
+	"strings"
+)
+
+// ParquetOptions configures the parquet sources of rows of type T (a struct with the parquet and prometheus tags)
+type ParquetOptions[T any] struct {
+	// Row groups of each source (0 for the whole file): the row groups of a file are read concurrently by different
+	// sources, up to Options.MaxParallelSources
+	RowGroupsPerSource int
+	Parallelism        int64        // Goroutines reading the columns of a row group (1 by default)
+	Columns            []string     // Columns read (by their parquet or field name, nested ones joined by '.'), all if empty
+	Transform          func(row *T) // Applied to each row after reading it (e.g. to shift the timestamps), if not nil
+}
+
+// ParquetSource reads a range of row groups of a parquet file. Each row group is a []*T table
+type ParquetSource[T any] struct {
+	path     string
+	first    int // First row group
+	end      int // Last row group + 1
+	opts     ParquetOptions[T]
+	fr       source.ParquetFile
+	pr       *reader.ParquetReader
+	rowGroup int
+}
+
+// ParquetSources returns the sources of the parquet files matching the patterns (see filepath.Match; a directory
+// matches all the .parquet files below it). The footers of the files are read to split them into ranges of row groups,
+// and to estimate the total of the job.
+func ParquetSources[T any](opts ParquetOptions[T], patterns ...string) ([]Source, error) {
+	if opts.Parallelism == 0 {
+		opts.Parallelism = 1
+	}
+	files, err := sourceFiles(patterns, ".parquet")
+	if err != nil {
+		return nil, err
+	}
+	var sources []Source
+	for _, path := range files {
+		rowGroups, err := parquetRowGroups(path)
+		if err != nil {
+			return nil, err
+		}
+		step := opts.RowGroupsPerSource
+		if step <= 0 {
+			step = rowGroups
+		}
+		for first := 0; first < rowGroups; first += step {
+			end := first + step
+			if end > rowGroups {
+				end = rowGroups
+			}
+			sources = append(sources, &ParquetSource[T]{path: path, first: first, end: end, opts: opts})
+		}
+	}
+	return sources, nil
+}
+
+// parquetRowGroups returns the number of row groups of the file, from its footer
+func parquetRowGroups(path string) (int, error) {
+	fr, err := local.NewLocalFileReader(path)
+	if err != nil {
+		return 0, err
+	}
+	defer fr.Close()
+	pr := reader.ParquetReader{PFile: fr}
+	if err := pr.ReadFooter(); err != nil {
+		return 0, fmt.Errorf("unable to read the footer of %s: %w", path, err)
+	}
+	return len(pr.Footer.RowGroups), nil
+}
+
+func (ps *ParquetSource[T]) Open(context.Context) (err error) {
+	if ps.fr, err = local.NewLocalFileReader(ps.path); err != nil {
+		return err
+	}
+	if ps.pr, err = reader.NewParquetReader(ps.fr, new(T), ps.opts.Parallelism); err != nil {
+		_ = ps.fr.Close()
+		return err
+	}
+	var skip int64
+	for _, rg := range ps.pr.Footer.RowGroups[:ps.first] {
+		skip += rg.NumRows
+	}
+	if err := ps.pr.SkipRows(skip); err != nil {
+		_ = ps.Close()
+		return err
+	}
+	if err := ps.project(); err != nil {
+		_ = ps.Close()
+		return err
+	}
+	ps.rowGroup = ps.first
+	return nil
+}
+
+// project closes the column buffers of the columns that are not read
+func (ps *ParquetSource[T]) project() error {
+	if len(ps.opts.Columns) == 0 {
+		return nil
+	}
+	columns := make(map[string]bool, len(ps.opts.Columns))
+	for _, c := range ps.opts.Columns {
+		columns[c] = false
+	}
+	for inPath, cb := range ps.pr.ColumnBuffers {
+		in := strings.Join(common.StrToPath(inPath)[1:], ".") // Without the root
+		ex := strings.Join(common.StrToPath(ps.pr.SchemaHandler.InPathToExPath[inPath])[1:], ".")
+		if _, ok := columns[in]; ok {
+			columns[in] = true
+			continue
+		}
+		if _, ok := columns[ex]; ok {
+			columns[ex] = true
+			continue
+		}
+		if cb != nil {
+			_ = cb.PFile.Close()
+		}
+		delete(ps.pr.ColumnBuffers, inPath)
+	}
+	for c, found := range columns {
+		if !found {
+			return fmt.Errorf("no column %s", c)
+		}
+	}
+	return nil
+}
+
+// Next returns the rows of the next row group
+func (ps *ParquetSource[T]) Next(context.Context) (interface{}, error) {
+	if ps.rowGroup == ps.end {
+		return nil, io.EOF
+	}
+	table := make([]*T, ps.pr.Footer.RowGroups[ps.rowGroup].NumRows)
+	if err := ps.pr.Read(&table); err != nil {
+		return nil, fmt.Errorf("row group %d: %w", ps.rowGroup, err)
+	}
+	ps.rowGroup++
+	if ps.opts.Transform != nil {
+		for _, row := range table {
+			ps.opts.Transform(row)
+		}
+	}
+	return table, nil
+}
+
+func (ps *ParquetSource[T]) Close() error {
+	ps.pr.ReadStop()
+	return ps.fr.Close()
+}
+
+// EstimateTotal returns the number of row groups of the source
+func (ps *ParquetSource[T]) EstimateTotal(context.Context) (int64, error) {
+	return int64(ps.end - ps.first), nil
+}
+
+func (ps *ParquetSource[T]) String() string {
+	if ps.opts.RowGroupsPerSource <= 0 {
+		return ps.path
+	}
+	return fmt.Sprintf("%s[%d:%d]", ps.path, ps.first, ps.end)
+}
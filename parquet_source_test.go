@@ -0,0 +1,122 @@
+package prometheus_backfill
+
+import (
+	"context"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const parquetFixture = "examples/alibaba/input/usage_1004.parquet" // 61 row groups
+
+type parquetUsage struct {
+	Id         string  `parquet:"name=id, type=BYTE_ARRAY, convertedtype=UTF8, repetitiontype=OPTIONAL"`
+	Timestamp  int64   `parquet:"name=timestamp, type=INT64, repetitiontype=OPTIONAL"`
+	Cpu        float64 `parquet:"name=cpu, type=DOUBLE, repetitiontype=OPTIONAL" prometheus:"metric_type:gauge"`
+	Mem        int64   `parquet:"name=mem, type=INT64, repetitiontype=OPTIONAL" prometheus:"metric_type:gauge"`
+	AppGroupId int64   `parquet:"name=aid, type=INT64, repetitiontype=OPTIONAL"`
+}
+
+// readParquet reads the row groups of the source
+func readParquet(t *testing.T, s Source) [][]*parquetUsage {
+	t.Helper()
+	if err := s.Open(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	var rowGroups [][]*parquetUsage
+	for {
+		table, err := s.Next(context.Background())
+		if err == io.EOF {
+			return rowGroups
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		rowGroups = append(rowGroups, table.([]*parquetUsage))
+	}
+}
+
+func TestParquetSourcesSplitRowGroups(t *testing.T) {
+	whole, err := ParquetSources(ParquetOptions[parquetUsage]{}, parquetFixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(whole) != 1 || whole[0].(*ParquetSource[parquetUsage]).String() != parquetFixture {
+		t.Fatalf("sources %v, expected the whole file", whole)
+	}
+	expected := readParquet(t, whole[0])
+	if len(expected) != 61 {
+		t.Fatalf("%d row groups, expected 61", len(expected))
+	}
+	sources, err := ParquetSources(ParquetOptions[parquetUsage]{RowGroupsPerSource: 20}, parquetFixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{"[0:20]", "[20:40]", "[40:60]", "[60:61]"}
+	if len(sources) != len(names) {
+		t.Fatalf("%d sources, expected %d", len(sources), len(names))
+	}
+	var total int64
+	var rowGroups [][]*parquetUsage
+	for i, s := range sources {
+		if name := s.(*ParquetSource[parquetUsage]).String(); name != parquetFixture+names[i] {
+			t.Errorf("source %s, expected %s", name, parquetFixture+names[i])
+		}
+		n, err := s.(TotalEstimator).EstimateTotal(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		total += n
+		// The rows of the previous row groups are skipped
+		read := readParquet(t, s)
+		if int64(len(read)) != n {
+			t.Errorf("source %s: %d row groups read, %d estimated", s, len(read), n)
+		}
+		rowGroups = append(rowGroups, read...)
+	}
+	if total != 61 {
+		t.Errorf("%d row groups estimated, expected 61", total)
+	}
+	if !reflect.DeepEqual(rowGroups, expected) {
+		t.Error("the rows of the split sources differ from the ones of the whole file")
+	}
+}
+
+func TestParquetSourceColumns(t *testing.T) {
+	sources, err := ParquetSources(ParquetOptions[parquetUsage]{
+		RowGroupsPerSource: 1,
+		Columns:            []string{"timestamp", "Cpu"}, // By parquet and field name
+		Transform:          func(row *parquetUsage) { row.Timestamp++ },
+	}, parquetFixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	all, err := ParquetSources(ParquetOptions[parquetUsage]{RowGroupsPerSource: 1}, parquetFixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	projected, expected := readParquet(t, sources[1])[0], readParquet(t, all[1])[0]
+	if len(projected) != len(expected) || len(projected) == 0 {
+		t.Fatalf("%d rows, expected %d", len(projected), len(expected))
+	}
+	for i, row := range projected {
+		e := expected[i]
+		if *row != (parquetUsage{Timestamp: e.Timestamp + 1, Cpu: e.Cpu}) {
+			t.Fatalf("row %d: %+v, expected only the timestamp (transformed) and the cpu of %+v", i, *row, *e)
+		}
+	}
+
+	sources, err = ParquetSources(ParquetOptions[parquetUsage]{Columns: []string{"timestamp", "gpu"}}, parquetFixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = sources[0].Open(context.Background())
+	if err == nil {
+		_ = sources[0].Close()
+	}
+	if err == nil || !strings.Contains(err.Error(), "gpu") {
+		t.Errorf("error %v, expected an unknown column", err)
+	}
+}
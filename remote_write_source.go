@@ -0,0 +1,253 @@
+package prometheus_backfill
+
+import (
+	"context"
+	"fmt"
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/prompb"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+const (
+	defaultRemoteWritePath     = "/api/v1/write"
+	maxRemoteWriteRequestBytes = 32 << 20 // Compressed
+)
+
+// RemoteWriteFileSource reads a captured remote-write request: a snappy-compressed prompb.WriteRequest, as sent by the
+// agents. Its samples are a single table
+type RemoteWriteFileSource struct {
+	path string
+	done bool
+}
+
+// RemoteWriteFiles returns the sources of the remote-write requests in the files matching the patterns (see
+// filepath.Match; a directory matches all the .snappy files below it)
+func RemoteWriteFiles(patterns ...string) ([]Source, error) {
+	files, err := sourceFiles(patterns, ".snappy")
+	if err != nil {
+		return nil, err
+	}
+	sources := make([]Source, 0, len(files))
+	for _, path := range files {
+		sources = append(sources, &RemoteWriteFileSource{path: path})
+	}
+	return sources, nil
+}
+
+func (rs *RemoteWriteFileSource) Open(context.Context) error {
+	return nil
+}
+
+// Next returns the samples of the request
+func (rs *RemoteWriteFileSource) Next(context.Context) (interface{}, error) {
+	if rs.done {
+		return nil, io.EOF
+	}
+	rs.done = true
+	b, err := ioutil.ReadFile(rs.path)
+	if err != nil {
+		return nil, err
+	}
+	req, err := decodeWriteRequest(b)
+	if err != nil {
+		return nil, err
+	}
+	return remoteWriteSamples(req), nil
+}
+
+func (rs *RemoteWriteFileSource) Close() error {
+	return nil
+}
+
+func (rs *RemoteWriteFileSource) String() string {
+	return rs.path
+}
+
+// RemoteWriteReceiver is a Source of the samples of the remote-write requests POSTed to a local HTTP endpoint, so that
+// the agents can write to the backfiller during a migration. Each request (up to 32MiB) is a table, acknowledged once
+// the handler has consumed it: its samples are then buffered in memory (or spilled to temporary files) until their
+// block is written, at the end of the job, at a checkpoint or when the watermark passes the end of their range. The
+// samples acknowledged before a crash of the job, and not in a written block, are lost: the agents don't resend them.
+// Requests are rejected with 503, so that the agents retry them, if the job failed or the receiver is stopping. The
+// source is exhausted when Stop is called
+type RemoteWriteReceiver struct {
+	addr     string
+	path     string
+	listener net.Listener
+	server   *http.Server
+	tables   chan *remoteWriteTable
+	stopping chan struct{}
+	stopOnce sync.Once
+	stopErr  error
+}
+
+// NewRemoteWriteReceiver creates a receiver listening on addr (e.g. localhost:9201) for the remote-write requests sent
+// to path (/api/v1/write if empty)
+func NewRemoteWriteReceiver(addr, path string) *RemoteWriteReceiver {
+	if path == "" {
+		path = defaultRemoteWritePath
+	}
+	return &RemoteWriteReceiver{
+		addr:     addr,
+		path:     path,
+		tables:   make(chan *remoteWriteTable),
+		stopping: make(chan struct{}),
+	}
+}
+
+// Open starts listening
+func (rr *RemoteWriteReceiver) Open(context.Context) (err error) {
+	if rr.listener, err = net.Listen("tcp", rr.addr); err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(rr.path, rr.handle)
+	rr.server = &http.Server{Handler: mux}
+	go func() {
+		if err := rr.server.Serve(rr.listener); err != nil && err != http.ErrServerClosed {
+			ErrLog("The remote-write receiver stopped: %v\n", err)
+		}
+	}()
+	Notice("Receiving remote-write requests on", rr.Addr()+rr.path)
+	return nil
+}
+
+// Addr returns the address the receiver listens on, once open
+func (rr *RemoteWriteReceiver) Addr() string {
+	if rr.listener == nil {
+		return rr.addr
+	}
+	return rr.listener.Addr().String()
+}
+
+func (rr *RemoteWriteReceiver) handle(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "only POST is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	if r.ContentLength > maxRemoteWriteRequestBytes {
+		http.Error(w, "the request is too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	b, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxRemoteWriteRequestBytes))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req, err := decodeWriteRequest(b)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	table := &remoteWriteTable{rows: remoteWriteSamples(req), consumed: make(chan error, 1)}
+	select {
+	case rr.tables <- table:
+	case <-rr.stopping:
+		http.Error(w, "the receiver is stopping", http.StatusServiceUnavailable)
+		return
+	case <-r.Context().Done():
+		return
+	}
+	// A table in flight when the receiver stops may still be stored: its samples, resent by the agent, are then
+	// duplicates resolved by the duplicate policy of the job
+	select {
+	case err := <-table.consumed:
+		if err != nil {
+			http.Error(w, "the job failed: "+err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case <-rr.stopping:
+		http.Error(w, "the receiver is stopping", http.StatusServiceUnavailable)
+	case <-r.Context().Done():
+	}
+}
+
+// Next returns the samples of the next request
+func (rr *RemoteWriteReceiver) Next(ctx context.Context) (interface{}, error) {
+	select {
+	case table := <-rr.tables:
+		return table, nil
+	case <-rr.stopping:
+		return nil, io.EOF
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Stop stops receiving requests: the requests in flight are rejected (with 503, so that the agents retry them) and
+// the source is exhausted. It is safe to call it more than once, from any goroutine
+func (rr *RemoteWriteReceiver) Stop() error {
+	rr.stopOnce.Do(func() {
+		close(rr.stopping)
+		if rr.server != nil {
+			rr.stopErr = rr.server.Shutdown(context.Background())
+		}
+	})
+	return rr.stopErr
+}
+
+func (rr *RemoteWriteReceiver) Close() error {
+	return rr.Stop()
+}
+
+func (rr *RemoteWriteReceiver) String() string {
+	return "remote-write receiver " + rr.Addr()
+}
+
+// remoteWriteTable is the table of a remote-write request, whose handler waits for the job to consume it
+type remoteWriteTable struct {
+	rows     []Sample
+	consumed chan error // Buffered: the job never waits for the handler
+}
+
+func (t *remoteWriteTable) samples(func(err error, row interface{})) []Sample {
+	return t.rows
+}
+
+func (t *remoteWriteTable) ack(err error) {
+	t.consumed <- err
+}
+
+func decodeWriteRequest(b []byte) (*prompb.WriteRequest, error) {
+	b, err := snappy.Decode(nil, b)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decompress the write request: %w", err)
+	}
+	var req prompb.WriteRequest
+	if err := req.Unmarshal(b); err != nil {
+		return nil, fmt.Errorf("unable to decode the write request: %w", err)
+	}
+	return &req, nil
+}
+
+// remoteWriteSamples returns the samples of the request. Samples of counters (according to the metadata of the
+// request) are stored as counters
+func remoteWriteSamples(req *prompb.WriteRequest) []Sample {
+	counters := make(map[string]bool)
+	for _, m := range req.Metadata {
+		if m.Type == prompb.MetricMetadata_COUNTER {
+			counters[m.MetricFamilyName] = true
+		}
+	}
+	var samples []Sample
+	for _, ts := range req.Timeseries {
+		labels := make(map[string]string, len(ts.Labels)) // Shared by the samples of the series
+		for _, l := range ts.Labels {
+			labels[l.Name] = l.Value
+		}
+		typ := "gauge"
+		if name := labels["__name__"]; counters[name] || counters[strings.TrimSuffix(name, "_total")] {
+			typ = "counter"
+		}
+		for _, s := range ts.Samples {
+			samples = append(samples, Sample{Labels: labels, Timestamp: s.Timestamp, Value: s.Value, Type: typ})
+		}
+	}
+	return samples
+}
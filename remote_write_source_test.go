@@ -0,0 +1,108 @@
+package prometheus_backfill
+
+import (
+	"bytes"
+	"context"
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/prompb"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// postWriteRequest sends the series to the receiver and returns the status of the response
+func postWriteRequest(t *testing.T, rr *RemoteWriteReceiver, series ...prompb.TimeSeries) int {
+	t.Helper()
+	b, err := (&prompb.WriteRequest{Timeseries: series}).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return postBody(t, rr, snappy.Encode(nil, b))
+}
+
+func postBody(t *testing.T, rr *RemoteWriteReceiver, body []byte) int {
+	t.Helper()
+	resp, err := http.Post("http://"+rr.addr+defaultRemoteWritePath, "application/x-protobuf", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	return resp.StatusCode
+}
+
+// startReceiver runs a job reading a new receiver, and returns the receiver once it is listening
+func startReceiver(t *testing.T, opts Options) (*RemoteWriteReceiver, <-chan error) {
+	t.Helper()
+	bh, err := New(nil, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0") // A free port
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	_ = l.Close()
+	rr := NewRemoteWriteReceiver(addr, "")
+	done := make(chan error, 1)
+	go func() { done <- bh.RunSources(context.Background(), rr) }()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		resp, err := http.Get("http://" + addr + defaultRemoteWritePath)
+		if err == nil {
+			_ = resp.Body.Close()
+			return rr, done
+		}
+		if time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+	}
+}
+
+func series(name string, t int64, v float64) prompb.TimeSeries {
+	return prompb.TimeSeries{
+		Labels:  []prompb.Label{{Name: "__name__", Value: name}},
+		Samples: []prompb.Sample{{Timestamp: t, Value: v}},
+	}
+}
+
+func TestRemoteWriteReceiver(t *testing.T) {
+	dir := t.TempDir()
+	rr, done := startReceiver(t, Options{OutputDir: dir, BlockDuration: time.Hour})
+	if status := postWriteRequest(t, rr, series("a", 1000, 1), series("b", 2000, 2)); status != http.StatusNoContent {
+		t.Errorf("status %d, expected %d", status, http.StatusNoContent)
+	}
+	if status := postBody(t, rr, []byte("not snappy")); status != http.StatusBadRequest {
+		t.Errorf("status %d of an invalid request, expected %d", status, http.StatusBadRequest)
+	}
+	if status := postBody(t, rr, make([]byte, maxRemoteWriteRequestBytes+1)); status != http.StatusRequestEntityTooLarge {
+		t.Errorf("status %d of a large request, expected %d", status, http.StatusRequestEntityTooLarge)
+	}
+	if err := rr.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	blocks := readTestBlocks(t, dir)
+	if len(blocks) != 1 || len(blocks[0].series) != 2 {
+		t.Fatalf("blocks %+v, expected a block with 2 series", blocks)
+	}
+}
+
+func TestRemoteWriteReceiverJobFailed(t *testing.T) {
+	rr, done := startReceiver(t, Options{OutputDir: t.TempDir()})
+	defer rr.Stop()
+	// A sample with no metric name makes the job fail: the request is not acknowledged
+	noName := prompb.TimeSeries{Samples: []prompb.Sample{{Timestamp: 1000, Value: 1}}}
+	if status := postWriteRequest(t, rr, noName); status != http.StatusServiceUnavailable {
+		t.Errorf("status %d, expected %d", status, http.StatusServiceUnavailable)
+	}
+	if status := postWriteRequest(t, rr, series("a", 1000, 1)); status != http.StatusServiceUnavailable {
+		t.Errorf("status %d after the failure, expected %d", status, http.StatusServiceUnavailable)
+	}
+	_ = rr.Stop()
+	if err := <-done; err == nil {
+		t.Error("the job didn't fail")
+	}
+}
@@ -0,0 +1,65 @@
+package prometheus_backfill
+
+import (
+	io_prometheus_client "github.com/prometheus/client_model/go"
+)
+
+// Sample is a sample of a series, for the tables without a row model: a []Sample table is stored as it is
+type Sample struct {
+	Labels    map[string]string // Labels of the series, with the metric name as __name__
+	Timestamp int64             // ms
+	Value     float64
+	Type      string // counter or gauge (the default)
+}
+
+// rawTable is a table of a source converted into samples by the handler, so that the errors of its rows follow the
+// error policy of the job
+type rawTable interface {
+	samples(reject func(err error, row interface{})) []Sample
+}
+
+// ackedTable is a table whose producer waits for the handler to consume it: ack is called once its samples are
+// buffered, or discarded because of the error of the job
+type ackedTable interface {
+	ack(err error)
+}
+
+// insertSamples inserts the samples into the time index, a row for each run of samples with the same timestamp
+func (bh *Handler) insertSamples(samples []Sample) {
+	var row []*io_prometheus_client.Metric
+	insert := func() {
+		if len(row) == 0 {
+			return
+		}
+		bh.indexLock.Lock()
+		bh.index.insert(row)
+		bh.indexLock.Unlock()
+		row = nil
+	}
+	for i := range samples {
+		s := &samples[i]
+		if s.Labels["__name__"] == "" {
+			bh.rowError(&SchemaError{Type: "Sample", Field: "Labels", Reason: "no metric name"}, s)
+			continue
+		}
+		ts, v := s.Timestamp, s.Value
+		metric := &io_prometheus_client.Metric{
+			Label:       bh.marshalLabelsMap(s.Labels),
+			TimestampMs: &ts,
+		}
+		switch s.Type {
+		case "counter":
+			metric.Counter = &io_prometheus_client.Counter{Value: &v}
+		case "gauge", "":
+			metric.Gauge = &io_prometheus_client.Gauge{Value: &v}
+		default:
+			bh.rowError(&SchemaError{Type: "Sample", Field: "Type", Reason: "unknown metric type " + s.Type}, s)
+			continue
+		}
+		if len(row) > 0 && *row[0].TimestampMs != ts {
+			insert()
+		}
+		row = append(row, metric)
+	}
+	insert()
+}
@@ -0,0 +1,168 @@
+package prometheus_backfill
+
+import (
+	io_prometheus_client "github.com/prometheus/client_model/go"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// schema is the conversion of the rows of a type into metrics, compiled once from its prometheus tags
+type schema struct {
+	typ              reflect.Type
+	timestamp        []int // Index of the Timestamp field (in seconds)
+	additionalLabels int   // Index of the GetAdditionalLabels method, -1 if missing
+	fields           []schemaField
+}
+
+// schemaField is a field of the row converted into a metric
+type schemaField struct {
+	index      []int
+	name       string            // Metric name
+	metricType string            // counter or gauge
+	labels     map[string]string // Labels of the tag, but metric_type
+}
+
+// schemas caches the schemas by row type
+var schemas sync.Map
+
+// schemaFor returns the schema of the rows of type t (a struct or a pointer to a struct), compiling it on its first
+// use
+func (bh *Handler) schemaFor(t reflect.Type) (*schema, error) {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if s, ok := schemas.Load(t); ok {
+		return s.(*schema), nil
+	}
+	s, err := bh.compileSchema(t)
+	if err != nil {
+		return nil, err
+	}
+	schemas.Store(t, s)
+	return s, nil
+}
+
+func (bh *Handler) compileSchema(t reflect.Type) (*schema, error) {
+	if t.Kind() != reflect.Struct {
+		return nil, &SchemaError{Type: t.String(), Reason: "the rows are not structs"}
+	}
+	s := &schema{typ: t, additionalLabels: -1}
+	ts, ok := t.FieldByName("Timestamp")
+	if !ok {
+		return nil, &SchemaError{Type: t.String(), Reason: "no Timestamp field"}
+	}
+	switch ts.Type.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+	default:
+		return nil, &SchemaError{Type: t.String(), Field: "Timestamp", Reason: "not an integer"}
+	}
+	s.timestamp = ts.Index
+	if m, ok := t.MethodByName("GetAdditionalLabels"); ok {
+		// The receiver is the first input
+		if m.Type.NumIn() != 1 || m.Type.NumOut() != 1 || m.Type.Out(0) != reflect.TypeOf(map[string]string(nil)) {
+			return nil, &SchemaError{Type: t.String(), Field: "GetAdditionalLabels",
+				Reason: "not a func() map[string]string method"}
+		}
+		s.additionalLabels = m.Index
+	}
+	if err := bh.compileFields(s, t, nil); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// compileFields adds to s the metrics of the fields of t, recursively in the nested structs
+func (bh *Handler) compileFields(s *schema, t reflect.Type, index []int) error {
+	for i := 0; i < t.NumField(); i++ { // columns
+		st := t.Field(i)
+		fieldIndex := append(append([]int(nil), index...), i)
+		switch st.Type.Kind() {
+		case reflect.Struct:
+			if err := bh.compileFields(s, st.Type, fieldIndex); err != nil {
+				return err
+			}
+		case reflect.Float64, reflect.Int64:
+			f, reason := bh.compileField(st)
+			if reason != "" {
+				return &SchemaError{Type: s.typ.String(), Field: st.Name, Reason: reason}
+			}
+			if f != nil {
+				f.index = fieldIndex
+				s.fields = append(s.fields, *f)
+			}
+		default:
+		}
+	}
+	return nil
+}
+
+// compileField returns the metric of the field, nil if it isn't a metric, or the reason why it can't be converted
+func (bh *Handler) compileField(st reflect.StructField) (*schemaField, string) {
+	labels := bh.getPrometheusLabels(st.Tag.Get("prometheus"))
+	metricType, ok := labels["metric_type"]
+	if !ok || metricType == "-" { // Ignore unwanted metrics
+		return nil, ""
+	}
+	f := &schemaField{
+		name:       st.Name,
+		metricType: metricType,
+		labels:     labels,
+	}
+	if bh.isMetricNameValid(labels["metric_name"]) {
+		f.name = labels["metric_name"]
+	}
+	switch metricType {
+	case "counter":
+		if !strings.HasSuffix(f.name, "_total") {
+			// expfmt.MetricFamiliyToOpenMetric row 91
+			f.name += "_total"
+		}
+	case "gauge":
+	case "histogram", "summary": // TODO
+		return nil, metricType + " metrics are not supported"
+	default:
+		return nil, "unknown metric type " + metricType
+	}
+	delete(f.labels, "metric_type")
+	return f, ""
+}
+
+// convertRow converts the row v (a value of the schema type) into metrics with the same timestamp
+func (bh *Handler) convertRow(s *schema, v reflect.Value) []*io_prometheus_client.Metric {
+	ts := v.FieldByIndex(s.timestamp).Int() * 1000 // See expfmt/openmetrics_create.go:348
+	var additional map[string]string
+	if s.additionalLabels >= 0 {
+		additional = v.Method(s.additionalLabels).Call(nil)[0].Interface().(map[string]string)
+	}
+	row := make([]*io_prometheus_client.Metric, 0, len(s.fields))
+	for i := range s.fields {
+		f := &s.fields[i]
+		field := v.FieldByIndex(f.index)
+		var value float64
+		if field.Kind() == reflect.Float64 {
+			value = field.Float()
+		} else {
+			value = float64(field.Int())
+		}
+		labels := make(map[string]string, len(f.labels)+len(additional)+1)
+		for k, l := range f.labels {
+			labels[k] = l
+		}
+		for k, l := range additional {
+			labels[k] = l
+		}
+		labels["__name__"] = f.name
+		metric := &io_prometheus_client.Metric{
+			Label:       bh.marshalLabelsMap(labels),
+			TimestampMs: &ts,
+		}
+		if f.metricType == "counter" {
+			metric.Counter = &io_prometheus_client.Counter{Value: &value}
+		} else {
+			metric.Gauge = &io_prometheus_client.Gauge{Value: &value}
+		}
+		row = append(row, metric)
+	}
+	return row
+}
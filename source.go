@@ -0,0 +1,219 @@
+package prometheus_backfill
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"go.uber.org/atomic"
+	"golang.org/x/sync/semaphore"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const defaultMaxParallelSources = int64(4)
+
+// Source produces the tables of a job (see RunSources). A Source is read by a single goroutine
+type Source interface {
+	// Open prepares the source to be read
+	Open(ctx context.Context) error
+	// Next returns the next table, or io.EOF when the source is exhausted. A table can be a SourceOffset, to report the
+	// progress of the source for checkpointing
+	Next(ctx context.Context) (interface{}, error)
+	// Close releases the resources of the source. It is called after Open succeeded, even if Next failed
+	Close() error
+}
+
+// TotalEstimator is a Source knowing the number of tables it will produce, used for the progress stats
+type TotalEstimator interface {
+	EstimateTotal(ctx context.Context) (int64, error)
+}
+
+// RunSources reads the sources concurrently (up to Options.MaxParallelSources at the same time), sends their tables to
+// the channel of the handler, closes it when all of them are exhausted and runs the job as RunJob does.
+// The channel of the handler must not be used by other producers (create the handler with a nil channel).
+// If Options.Tables is zero and all the sources are TotalEstimators, the total is the sum of their estimates.
+// An error of a source (a *SourceError) makes the job fail, and the other sources stop at their next table.
+// The tables of each source are sent as a ProducerTable: a checkpoint is taken only when every source has returned a
+// SourceOffset after its last table. None of the built-in sources returns offsets or resumes from ResumeOffset, so
+// checkpointing has no effect with them.
+func (bh *Handler) RunSources(ctx context.Context, sources ...Source) error {
+	if bh.total.Load() == 0 {
+		bh.estimateTotal(ctx, sources)
+	}
+	go bh.readSources(ctx, sources)
+	return bh.RunJob(ctx)
+}
+
+// estimateTotal sets the total of the job to the sum of the estimates of the sources, if all of them can estimate it
+func (bh *Handler) estimateTotal(ctx context.Context, sources []Source) {
+	estimators := make([]TotalEstimator, 0, len(sources))
+	for _, s := range sources {
+		e, ok := s.(TotalEstimator)
+		if !ok {
+			return // The total is unknown
+		}
+		estimators = append(estimators, e)
+	}
+	Notice2("Estimating the number of tables of", len(sources), "sources")
+	sem := semaphore.NewWeighted(bh.maxParallelSources)
+	wg := sync.WaitGroup{}
+	var total atomic.Int64
+	var failed atomic.Bool
+	for i, e := range estimators {
+		if sem.Acquire(ctx, 1) != nil {
+			failed.Store(true) // Cancelled
+			break
+		}
+		wg.Add(1)
+		i, e := i, e
+		go func() {
+			defer wg.Done()
+			defer sem.Release(1)
+			n, err := e.EstimateTotal(ctx)
+			if err != nil {
+				ErrLog("Unable to estimate the number of tables of %s: %v\n", sourceName(i, sources[i]), err)
+				failed.Store(true)
+				return
+			}
+			total.Add(n)
+		}()
+	}
+	wg.Wait()
+	if !failed.Load() {
+		bh.total.Store(total.Load())
+	}
+}
+
+// readSources sends the tables of the sources to the channel, and closes it when all of them are exhausted, the job
+// failed or it was cancelled
+func (bh *Handler) readSources(ctx context.Context, sources []Source) {
+	sem := semaphore.NewWeighted(bh.maxParallelSources)
+	wg := sync.WaitGroup{}
+	for i, s := range sources {
+		if sem.Acquire(ctx, 1) != nil || bh.failed.Load() {
+			break
+		}
+		wg.Add(1)
+		i, s := i, s
+		go func() {
+			defer wg.Done()
+			defer sem.Release(1)
+			name := sourceName(i, s)
+			if err := bh.readSource(ctx, name, s); err != nil {
+				bh.fail(&SourceError{Source: name, Err: err})
+			}
+		}()
+	}
+	wg.Wait()
+	close(bh.ch)
+}
+
+// readSource sends the tables of the source to the channel, as the ones of the producer name
+func (bh *Handler) readSource(ctx context.Context, name string, s Source) (err error) {
+	if err := s.Open(ctx); err != nil {
+		return fmt.Errorf("open: %w", err)
+	}
+	defer func() {
+		if cerr := s.Close(); cerr != nil && err == nil {
+			err = fmt.Errorf("close: %w", cerr)
+		}
+	}()
+	for !bh.failed.Load() {
+		table, err := s.Next(ctx)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil // Cancelled
+			}
+			return err
+		}
+		select {
+		case bh.ch <- ProducerTable{Producer: name, Table: table}:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+	return nil
+}
+
+func sourceName(i int, s Source) string {
+	if stringer, ok := s.(fmt.Stringer); ok {
+		return stringer.String()
+	}
+	return fmt.Sprintf("source %d (%T)", i, s)
+}
+
+// sourceFiles returns the files matching the patterns (see filepath.Match). A directory matches the files below it with
+// one of the extensions
+func sourceFiles(patterns []string, extensions ...string) ([]string, error) {
+	var files []string
+	for _, pattern := range patterns {
+		if info, err := os.Stat(pattern); err == nil && info.IsDir() {
+			err := filepath.Walk(pattern, func(path string, info os.FileInfo, err error) error {
+				if err != nil {
+					return err
+				}
+				if info.IsDir() {
+					return nil
+				}
+				for _, ext := range extensions {
+					if strings.HasSuffix(path, ext) {
+						files = append(files, path)
+						break
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, err
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("no file matches %s", pattern)
+		}
+		files = append(files, matches...)
+	}
+	return files, nil
+}
+
+// openSourceFile opens the file at path, decompressing it if its extension is .gz
+func openSourceFile(path string) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(path, ".gz") {
+		return f, nil
+	}
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return &gzipFile{Reader: gz, file: f}, nil
+}
+
+// gzipFile closes both the gzip reader and its file
+type gzipFile struct {
+	*gzip.Reader
+	file *os.File
+}
+
+func (f *gzipFile) Close() error {
+	err := f.Reader.Close()
+	if ferr := f.file.Close(); err == nil {
+		err = ferr
+	}
+	return err
+}
@@ -0,0 +1,147 @@
+package prometheus_backfill
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeSource produces its tables, then nextErr (io.EOF if nil)
+type fakeSource struct {
+	name     string
+	tables   []interface{}
+	openErr  error
+	nextErr  error
+	closeErr error
+	closed   bool
+}
+
+func (s *fakeSource) Open(context.Context) error {
+	return s.openErr
+}
+
+func (s *fakeSource) Next(context.Context) (interface{}, error) {
+	if len(s.tables) == 0 {
+		if s.nextErr != nil {
+			return nil, s.nextErr
+		}
+		return nil, io.EOF
+	}
+	table := s.tables[0]
+	s.tables = s.tables[1:]
+	return table, nil
+}
+
+func (s *fakeSource) Close() error {
+	s.closed = true
+	return s.closeErr
+}
+
+func (s *fakeSource) String() string {
+	return s.name
+}
+
+// fakeEstimator is a fakeSource estimating its total
+type fakeEstimator struct {
+	fakeSource
+	total int64
+	err   error
+}
+
+func (s *fakeEstimator) EstimateTotal(context.Context) (int64, error) {
+	return s.total, s.err
+}
+
+func TestRunSources(t *testing.T) {
+	dir := t.TempDir()
+	bh, err := New(nil, Options{OutputDir: dir, BlockDuration: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &fakeEstimator{fakeSource: fakeSource{name: "a", tables: []interface{}{
+		[]Sample{gauge("m", 1000, 1, "source", "a")}, []Sample{gauge("m", 2000, 2, "source", "a")}}}, total: 2}
+	b := &fakeEstimator{fakeSource: fakeSource{name: "b", tables: []interface{}{
+		[]Sample{gauge("m", 1000, 3, "source", "b")}}}, total: 1}
+	if err := bh.RunSources(context.Background(), a, b); err != nil {
+		t.Fatal(err)
+	}
+	if p := bh.Progress(); p.Total != 3 || p.Tables != 3 {
+		t.Errorf("progress %+v, expected 3 tables of 3", p)
+	}
+	if !a.closed || !b.closed {
+		t.Error("the sources have not been closed")
+	}
+	blocks := readTestBlocks(t, dir)
+	if len(blocks) != 1 || len(blocks[0].series[`{__name__="m", source="a"}`]) != 2 ||
+		len(blocks[0].series[`{__name__="m", source="b"}`]) != 1 {
+		t.Errorf("blocks %+v, expected the samples of both sources", blocks)
+	}
+}
+
+func TestRunSourcesEstimate(t *testing.T) {
+	estimator := func(total int64, err error) Source {
+		return &fakeEstimator{fakeSource: fakeSource{name: "estimator"}, total: total, err: err}
+	}
+	tests := []struct {
+		name    string
+		tables  int64 // Options.Tables
+		sources []Source
+		total   int64
+	}{
+		{"estimators", 0, []Source{estimator(2, nil), estimator(3, nil)}, 5},
+		{"not an estimator", 0, []Source{estimator(2, nil), &fakeSource{name: "source"}}, 0},
+		{"estimate error", 0, []Source{estimator(2, nil), estimator(0, errors.New("unknown"))}, 0},
+		{"tables option", 7, []Source{estimator(2, nil)}, 7},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bh, err := New(nil, Options{OutputDir: t.TempDir(), Tables: tt.tables})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := bh.RunSources(context.Background(), tt.sources...); err != nil {
+				t.Fatal(err)
+			}
+			if total := bh.Progress().Total; total != tt.total {
+				t.Errorf("total %d, expected %d", total, tt.total)
+			}
+		})
+	}
+}
+
+func TestRunSourcesErrors(t *testing.T) {
+	failure := errors.New("failure")
+	tables := []interface{}{[]Sample{gauge("m", 1000, 1)}}
+	tests := []struct {
+		name   string
+		source *fakeSource
+		prefix string
+		closed bool
+	}{
+		{"open", &fakeSource{name: "broken", openErr: failure}, "open: ", false},
+		{"next", &fakeSource{name: "broken", tables: tables, nextErr: failure}, "", true},
+		{"close", &fakeSource{name: "broken", tables: tables, closeErr: failure}, "close: ", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bh, err := New(nil, Options{OutputDir: t.TempDir()})
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = bh.RunSources(context.Background(), tt.source)
+			var sourceErr *SourceError
+			if !errors.As(err, &sourceErr) || !errors.Is(err, failure) {
+				t.Fatalf("error %v, expected a source error", err)
+			}
+			if sourceErr.Source != "broken" || !strings.HasPrefix(sourceErr.Err.Error(), tt.prefix) {
+				t.Errorf("error of %s: %v, expected %q", sourceErr.Source, sourceErr.Err, tt.prefix)
+			}
+			if tt.source.closed != tt.closed {
+				t.Errorf("source closed: %t, expected %t", tt.source.closed, tt.closed)
+			}
+		})
+	}
+}
@@ -0,0 +1,342 @@
+package prometheus_backfill
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/binary"
+	"fmt"
+	io_prometheus_client "github.com/prometheus/client_model/go"
+	labels2 "github.com/prometheus/prometheus/pkg/labels"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+)
+
+// maxOpenRuns is the maximum number of run files merged at once. When more runs are spilled, they are merged in
+// intermediate (bigger) runs first.
+const maxOpenRuns = 128
+
+const (
+	runSampleGauge byte = iota
+	runSampleCounter
+)
+
+// setExternalSort creates the spill directory inside tmpDir
+func (bh *Handler) setExternalSort(tmpDir string) error {
+	dir, err := ioutil.TempDir(tmpDir, "backfill-spill-")
+	if err != nil {
+		return fmt.Errorf("unable to create the spill directory: %w", err)
+	}
+	bh.spillDir = dir
+	return nil
+}
+
+// spill writes the sorted samples to a new run file. It is thread-safe.
+func (bh *Handler) spill(toStore []auxStoreStruct) error {
+	if len(toStore) == 0 {
+		return nil
+	}
+	path, err := writeRun(bh.spillDir, toStore)
+	if err != nil {
+		return err
+	}
+	bh.spillLock.Lock()
+	bh.runs = append(bh.runs, path)
+	bh.spillLock.Unlock()
+	return nil
+}
+
+// mergeAndStore merges the spilled runs in time order and stores them in batches of storeThreshold samples. Each range
+// is flushed as soon as the merged samples pass its end: the pool never buffers (and spills again) more than one range.
+// mergeAndStore is not thread-safe! Use with the writerLock.
+func (bh *Handler) mergeAndStore() error {
+	bh.spillLock.Lock()
+	runs := bh.runs
+	bh.runs = nil
+	bh.spillLock.Unlock()
+	runs, err := reduceRuns(bh.spillDir, runs)
+	if err != nil {
+		return err
+	}
+	Notice3("Merging", len(runs), "spilled runs")
+	batch := make([]auxStoreStruct, 0, bh.storeThreshold)
+	end := int64(math.MinInt64) // End of the range of the last merged sample
+	if err := mergeRuns(runs, func(m *auxStoreStruct) error {
+		if t := *m.metric.TimestampMs; t >= end {
+			bh.storeBatch(batch)
+			batch = make([]auxStoreStruct, 0, bh.storeThreshold)
+			if err := bh.writers.flushBefore(t); err != nil {
+				bh.fail(err)
+			}
+			end = bh.writers.blockRange(t) + bh.blockDuration
+		}
+		batch = append(batch, *m)
+		if int64(len(batch)) >= bh.storeThreshold {
+			bh.storeBatch(batch)
+			batch = make([]auxStoreStruct, 0, bh.storeThreshold)
+		}
+		return nil
+	}); err != nil {
+		return fmt.Errorf("unable to merge the run files: %w", err)
+	}
+	bh.storeBatch(batch)
+	return nil
+}
+
+// writeRun writes the sorted samples to a new run file in dir and returns its path
+func writeRun(dir string, samples []auxStoreStruct) (string, error) {
+	rw, err := newRunWriter(dir)
+	if err != nil {
+		return "", fmt.Errorf("unable to create a run file: %w", err)
+	}
+	for i := range samples {
+		if err := rw.write(&samples[i]); err != nil {
+			_ = rw.close()
+			return "", fmt.Errorf("unable to write to the run file %s: %w", rw.path(), err)
+		}
+	}
+	if err := rw.close(); err != nil {
+		return "", fmt.Errorf("unable to close the run file %s: %w", rw.path(), err)
+	}
+	return rw.path(), nil
+}
+
+// reduceRuns merges the consecutive runs in intermediate (bigger) runs in dir, until they are at most maxOpenRuns.
+// The order of the runs is kept, so is the one of the samples with the same timestamp.
+func reduceRuns(dir string, runs []string) ([]string, error) {
+	for len(runs) > maxOpenRuns {
+		var merged []string
+		for i := 0; i < len(runs); i += maxOpenRuns {
+			j := i + maxOpenRuns
+			if j > len(runs) {
+				j = len(runs)
+			}
+			rw, err := newRunWriter(dir)
+			if err != nil {
+				return nil, fmt.Errorf("unable to create a run file: %w", err)
+			}
+			if err := mergeRuns(runs[i:j], rw.write); err != nil {
+				_ = rw.close()
+				return nil, fmt.Errorf("unable to merge the run files: %w", err)
+			}
+			if err := rw.close(); err != nil {
+				return nil, fmt.Errorf("unable to close the run file %s: %w", rw.path(), err)
+			}
+			merged = append(merged, rw.path())
+		}
+		runs = merged
+	}
+	return runs, nil
+}
+
+// mergeRuns visits the samples of the sorted runs in time order (samples with the same timestamp by run order) and
+// deletes the run files
+func mergeRuns(runs []string, visit func(m *auxStoreStruct) error) error {
+	h := make(runHeap, 0, len(runs))
+	defer func() {
+		for _, r := range h {
+			_ = r.close()
+		}
+	}()
+	for i, path := range runs {
+		r, err := openRun(path, i)
+		if err != nil {
+			return err
+		}
+		ok, err := r.next()
+		if err != nil {
+			_ = r.close()
+			return err
+		}
+		if ok {
+			h = append(h, r)
+		} else if err := r.close(); err != nil {
+			return err
+		}
+	}
+	heap.Init(&h)
+	for h.Len() > 0 {
+		r := h[0]
+		if err := visit(&r.current); err != nil {
+			return err
+		}
+		ok, err := r.next()
+		if err != nil {
+			return err
+		}
+		if ok {
+			heap.Fix(&h, 0)
+			continue
+		}
+		heap.Pop(&h)
+		if err := r.close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type runWriter struct {
+	f   *os.File
+	w   *bufio.Writer
+	buf [binary.MaxVarintLen64]byte
+}
+
+func newRunWriter(dir string) (*runWriter, error) {
+	f, err := ioutil.TempFile(dir, "run-*")
+	if err != nil {
+		return nil, err
+	}
+	return &runWriter{f: f, w: bufio.NewWriter(f)}, nil
+}
+
+func (rw *runWriter) path() string {
+	return rw.f.Name()
+}
+
+func (rw *runWriter) uvarint(x uint64) error {
+	n := binary.PutUvarint(rw.buf[:], x)
+	_, err := rw.w.Write(rw.buf[:n])
+	return err
+}
+
+func (rw *runWriter) string(s string) error {
+	if err := rw.uvarint(uint64(len(s))); err != nil {
+		return err
+	}
+	_, err := rw.w.WriteString(s)
+	return err
+}
+
+// write encodes a sample as: kind, timestamp, value, number of labels, labels (name and value as length and bytes)
+func (rw *runWriter) write(m *auxStoreStruct) error {
+	kind := runSampleGauge
+	if m.metric.Counter != nil {
+		kind = runSampleCounter
+	}
+	if err := rw.w.WriteByte(kind); err != nil {
+		return err
+	}
+	n := binary.PutVarint(rw.buf[:], *m.metric.TimestampMs)
+	if _, err := rw.w.Write(rw.buf[:n]); err != nil {
+		return err
+	}
+	binary.LittleEndian.PutUint64(rw.buf[:8], math.Float64bits(sampleValue(m.metric)))
+	if _, err := rw.w.Write(rw.buf[:8]); err != nil {
+		return err
+	}
+	if err := rw.uvarint(uint64(len(m.labels))); err != nil {
+		return err
+	}
+	for _, l := range m.labels {
+		if err := rw.string(l.Name); err != nil {
+			return err
+		}
+		if err := rw.string(l.Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (rw *runWriter) close() error {
+	if err := rw.w.Flush(); err != nil {
+		_ = rw.f.Close()
+		return err
+	}
+	return rw.f.Close()
+}
+
+type runReader struct {
+	f       *os.File
+	r       *bufio.Reader
+	order   int // Position of the run, to merge the samples with the same timestamp by run order
+	current auxStoreStruct
+}
+
+func openRun(path string, order int) (*runReader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &runReader{f: f, r: bufio.NewReader(f), order: order}, nil
+}
+
+func (rr *runReader) string() (string, error) {
+	n, err := binary.ReadUvarint(rr.r)
+	if err != nil {
+		return "", err
+	}
+	b := make([]byte, n)
+	_, err = io.ReadFull(rr.r, b)
+	return string(b), err
+}
+
+// next decodes the next sample of the run into current, it returns false at the end of the run
+func (rr *runReader) next() (bool, error) {
+	kind, err := rr.r.ReadByte()
+	if err == io.EOF {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	ts, err := binary.ReadVarint(rr.r)
+	if err != nil {
+		return false, err
+	}
+	var b [8]byte
+	if _, err := io.ReadFull(rr.r, b[:]); err != nil {
+		return false, err
+	}
+	v := math.Float64frombits(binary.LittleEndian.Uint64(b[:]))
+	n, err := binary.ReadUvarint(rr.r)
+	if err != nil {
+		return false, err
+	}
+	labels := make([]labels2.Label, n)
+	for i := range labels {
+		if labels[i].Name, err = rr.string(); err != nil {
+			return false, err
+		}
+		if labels[i].Value, err = rr.string(); err != nil {
+			return false, err
+		}
+	}
+	metric := &io_prometheus_client.Metric{TimestampMs: &ts}
+	if kind == runSampleCounter {
+		metric.Counter = &io_prometheus_client.Counter{Value: &v}
+	} else {
+		metric.Gauge = &io_prometheus_client.Gauge{Value: &v}
+	}
+	rr.current = auxStoreStruct{metric: metric, labels: labels}
+	return true, nil
+}
+
+// close closes and deletes the run file
+func (rr *runReader) close() error {
+	if err := rr.f.Close(); err != nil {
+		return err
+	}
+	return os.Remove(rr.f.Name())
+}
+
+type runHeap []*runReader
+
+func (h runHeap) Len() int { return len(h) }
+func (h runHeap) Less(i, j int) bool {
+	ti, tj := *h[i].current.metric.TimestampMs, *h[j].current.metric.TimestampMs
+	if ti == tj {
+		return h[i].order < h[j].order
+	}
+	return ti < tj
+}
+func (h runHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *runHeap) Push(x interface{}) { *h = append(*h, x.(*runReader)) }
+func (h *runHeap) Pop() interface{} {
+	old := *h
+	r := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return r
+}
@@ -0,0 +1,195 @@
+package prometheus_backfill
+
+import (
+	"fmt"
+	io_prometheus_client "github.com/prometheus/client_model/go"
+	labels2 "github.com/prometheus/prometheus/pkg/labels"
+	"io/ioutil"
+	"math"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// runSample returns a sample at ts, a counter if counter is true
+func runSample(ts int64, v float64, counter bool, labels ...string) auxStoreStruct {
+	metric := &io_prometheus_client.Metric{TimestampMs: &ts}
+	if counter {
+		metric.Counter = &io_prometheus_client.Counter{Value: &v}
+	} else {
+		metric.Gauge = &io_prometheus_client.Gauge{Value: &v}
+	}
+	return auxStoreStruct{metric: metric, labels: labels2.FromStrings(labels...)}
+}
+
+func TestRunRoundTrip(t *testing.T) {
+	samples := []auxStoreStruct{
+		runSample(-5, -1.5, false, "__name__", "g", "a", "1"),
+		runSample(0, 0, true, "__name__", "c_total"),
+		runSample(1, math.Inf(1), false, "__name__", "g", "empty", "", "unicode", "héllo\nworld"),
+		runSample(math.MaxInt64, math.MaxFloat64, true, "__name__", "c_total", "b", "2"),
+	}
+	path, err := writeRun(t.TempDir(), samples)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := openRun(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, expected := range samples {
+		ok, err := r.next()
+		if err != nil || !ok {
+			t.Fatalf("sample %d: %t, %v", i, ok, err)
+		}
+		m := r.current
+		switch {
+		case *m.metric.TimestampMs != *expected.metric.TimestampMs:
+			t.Errorf("sample %d: timestamp %d, expected %d", i, *m.metric.TimestampMs, *expected.metric.TimestampMs)
+		case sampleValue(m.metric) != sampleValue(expected.metric):
+			t.Errorf("sample %d: value %v, expected %v", i, sampleValue(m.metric), sampleValue(expected.metric))
+		case (m.metric.Counter != nil) != (expected.metric.Counter != nil):
+			t.Errorf("sample %d: counter %t, expected %t", i, m.metric.Counter != nil, expected.metric.Counter != nil)
+		case !reflect.DeepEqual(m.labels, expected.labels):
+			t.Errorf("sample %d: labels %v, expected %v", i, m.labels, expected.labels)
+		}
+	}
+	if ok, err := r.next(); ok || err != nil {
+		t.Errorf("end of the run: %t, %v", ok, err)
+	}
+	if err := r.close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openRun(path, 0); err == nil {
+		t.Error("the run file has not been deleted")
+	}
+}
+
+func TestMergeManyRuns(t *testing.T) {
+	dir := t.TempDir()
+	const runs, perRun = 3*maxOpenRuns + 5, 4
+	var paths []string
+	for i := 0; i < runs; i++ {
+		samples := make([]auxStoreStruct, 0, perRun)
+		for j := 0; j < perRun; j++ {
+			// The runs interleave, and all of them have a sample at 0: they are merged by run order
+			ts := int64(j * (i%7 + 1))
+			samples = append(samples, runSample(ts, float64(i), false, "__name__", "m", "run", fmt.Sprint(i)))
+		}
+		path, err := writeRun(dir, samples)
+		if err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, path)
+	}
+	paths, err := reduceRuns(dir, paths)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) > maxOpenRuns {
+		t.Fatalf("%d runs left, expected at most %d", len(paths), maxOpenRuns)
+	}
+	var merged []auxStoreStruct
+	if err := mergeRuns(paths, func(m *auxStoreStruct) error {
+		merged = append(merged, *m)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(merged) != runs*perRun {
+		t.Fatalf("%d samples merged, expected %d", len(merged), runs*perRun)
+	}
+	for i := 1; i < len(merged); i++ {
+		prev, cur := merged[i-1], merged[i]
+		switch {
+		case *cur.metric.TimestampMs < *prev.metric.TimestampMs:
+			t.Fatalf("sample %d at %d after %d", i, *cur.metric.TimestampMs, *prev.metric.TimestampMs)
+		case *cur.metric.TimestampMs == *prev.metric.TimestampMs && sampleValue(cur.metric) < sampleValue(prev.metric):
+			t.Fatalf("samples at %d not merged by run order", *cur.metric.TimestampMs)
+		}
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Errorf("%d run files left", len(files))
+	}
+}
+
+func TestExternalSort(t *testing.T) {
+	const ranges, perRange = 4, 30
+	hour := int64(time.Hour / time.Millisecond)
+	var tables []interface{}
+	for i := 0; i < ranges*perRange; i++ { // Jumps across the ranges
+		ts := int64((i*37)%(ranges*perRange)) * hour / perRange
+		tables = append(tables, []Sample{gauge("m", ts, float64(i), "id", "a"), gauge("m", ts, float64(i), "id", "b")})
+	}
+	dir, sortDir := t.TempDir(), t.TempDir()
+	_, err := runTestJob(t, Options{
+		OutputDir:           dir,
+		BlockDuration:       time.Hour,
+		StoreThreshold:      8,
+		MaxOpenBlockWriters: 1,
+		ExternalSort:        true,
+		ExternalSortDir:     sortDir,
+		VerifyBlocks:        true,
+	}, tables...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocks := readTestBlocks(t, dir)
+	if len(blocks) != ranges {
+		t.Fatalf("%d blocks, expected %d", len(blocks), ranges)
+	}
+	checkNoOverlaps(t, blocks)
+	for _, b := range blocks {
+		for _, id := range []string{"a", "b"} {
+			samples := b.series[fmt.Sprintf(`{__name__="m", id="%s"}`, id)]
+			if len(samples) != perRange {
+				t.Errorf("block [%d, %d): %d samples of %s, expected %d", b.meta.MinTime, b.meta.MaxTime,
+					len(samples), id, perRange)
+			}
+		}
+	}
+	if files, _ := ioutil.ReadDir(sortDir); len(files) != 0 {
+		t.Errorf("%d files left in the external sort directory", len(files))
+	}
+}
+
+func TestMergeFlushesPassedRanges(t *testing.T) {
+	dir := t.TempDir()
+	bh, err := New(nil, Options{OutputDir: dir, BlockDuration: time.Second, MaxOpenBlockWriters: 1,
+		ExternalSort: true, ExternalSortDir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bh.writers, err = bh.newWriterPool(dir); err != nil {
+		t.Fatal(err)
+	}
+	// Two runs with samples of three ranges each
+	for _, run := range [][]int64{{0, 1000, 2000}, {500, 1500, 2500}} {
+		var samples []auxStoreStruct
+		for _, ts := range run {
+			samples = append(samples, runSample(ts, 1, false, "__name__", "m"))
+		}
+		if err := bh.spill(samples); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := bh.mergeAndStore(); err != nil {
+		t.Fatal(err)
+	}
+	// The last range is flushed with the pool
+	if len(bh.writers.flushed) != 2 || bh.writers.spillDir != "" {
+		t.Errorf("%d blocks flushed, spill directory %q: the passed ranges should be flushed", len(bh.writers.flushed),
+			bh.writers.spillDir)
+	}
+	bh.closePool(bh.writers)
+	if err := bh.err(); err != nil {
+		t.Fatal(err)
+	}
+	blocks := readTestBlocks(t, dir)
+	if len(blocks) != 3 {
+		t.Fatalf("%d blocks, expected 3", len(blocks))
+	}
+	checkNoOverlaps(t, blocks)
+	_ = os.RemoveAll(bh.spillDir)
+}
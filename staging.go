@@ -0,0 +1,106 @@
+package prometheus_backfill
+
+import (
+	"fmt"
+	"github.com/oklog/ulid"
+	"github.com/prometheus/prometheus/tsdb/fileutil"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// stagingDirName is the directory, inside the output one, where blocks are written before being moved into place.
+// Prometheus ignores it, as its name is not a ULID.
+const stagingDirName = ".staging"
+
+type AtomicOutput string
+
+const (
+	AtomicOutputNone  AtomicOutput = ""      // Blocks are written directly into the output directory
+	AtomicOutputBlock AtomicOutput = "block" // Each block is moved into the output directory once flushed and verified
+	AtomicOutputJob   AtomicOutput = "job"   // Blocks are moved into the output directory when the job succeeds
+)
+
+func (a AtomicOutput) validate() error {
+	switch a {
+	case AtomicOutputNone, AtomicOutputBlock, AtomicOutputJob:
+		return nil
+	}
+	return fmt.Errorf("unknown atomic output mode %s", a)
+}
+
+// cleanupOutputDir removes the staging directory (but the blocks to keep, committed by a checkpoint) and the blocks
+// left half-written (*.tmp-for-creation) in dir by a previous run
+func cleanupOutputDir(dir string, keep map[string]bool) error {
+	staging := filepath.Join(dir, stagingDirName)
+	if len(keep) == 0 {
+		if err := os.RemoveAll(staging); err != nil {
+			return err
+		}
+	} else if files, err := ioutil.ReadDir(staging); err == nil {
+		for _, f := range files {
+			if !keep[f.Name()] {
+				if err := os.RemoveAll(filepath.Join(staging, f.Name())); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if f.IsDir() && strings.HasSuffix(f.Name(), ".tmp-for-creation") {
+			Notice4("Removing partial block", f.Name())
+			if err := os.RemoveAll(filepath.Join(dir, f.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// writeDir returns the directory where the blocks for outputDir are written
+func (bh *Handler) writeDir(outputDir string) string {
+	if bh.atomicOutput == AtomicOutputNone {
+		return outputDir
+	}
+	return filepath.Join(outputDir, stagingDirName)
+}
+
+// blocksDir returns the directory where the blocks flushed by the pool are before the end of the job
+func (bh *Handler) blocksDir(p *writerPool) string {
+	if bh.atomicOutput == AtomicOutputBlock {
+		return p.outputDir
+	}
+	return p.dir
+}
+
+// promote moves the block from the staging directory into the output directory
+func promote(p *writerPool, id ulid.ULID) error {
+	return fileutil.Replace(filepath.Join(p.dir, id.String()), filepath.Join(p.outputDir, id.String()))
+}
+
+// promoteAll moves all the blocks of the pool from the staging directory into the output directory, if the job
+// succeeded
+func (bh *Handler) promoteAll(p *writerPool) {
+	if bh.atomicOutput != AtomicOutputJob {
+		return
+	}
+	if errs := bh.Errors(); len(errs) > 0 || bh.cancelled.Load() {
+		if bh.checkpoint != nil {
+			ErrLog("The job didn't complete, its blocks are left in %s to resume it\n", p.dir)
+		}
+		return
+	}
+	for _, id := range p.flushed {
+		if err := promote(p, id); err != nil {
+			bh.reportError(fmt.Errorf("unable to move block %s into %s: %w", id, p.outputDir, err))
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package prometheus_backfill
+
+import (
+	"context"
+	"github.com/go-kit/kit/log"
+	"github.com/oklog/ulid"
+	"github.com/prometheus/prometheus/tsdb"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// blockDirs returns the number of blocks in dir
+func blockDirs(t *testing.T, dir string) int {
+	t.Helper()
+	files, err := ioutil.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	n := 0
+	for _, f := range files {
+		if _, err := ulid.ParseStrict(f.Name()); err == nil && f.IsDir() {
+			n++
+		}
+	}
+	return n
+}
+
+func TestAtomicOutputJob(t *testing.T) {
+	hour := int64(time.Hour / time.Millisecond)
+	dir := t.TempDir()
+	staging := filepath.Join(dir, stagingDirName)
+	ch := make(chan interface{})
+	// The ranges are closed (and their blocks flushed) as soon as a sample of the next one is stored
+	bh, err := New(ch, Options{OutputDir: dir, BlockDuration: time.Hour, StoreThreshold: 1, MaxParallelConsumes: 1,
+		LatePolicy: LateDrop, AtomicOutput: AtomicOutputJob})
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- bh.RunJob(context.Background()) }()
+	for i := int64(0); i < 4; i++ {
+		ch <- []Sample{gauge("m", i*hour, float64(i))}
+	}
+	for deadline := time.Now().Add(5 * time.Second); blockDirs(t, staging) == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("no blocks flushed in the staging directory")
+		}
+	}
+	if n := blockDirs(t, dir); n != 0 {
+		t.Errorf("%d blocks in the output directory before the end of the job", n)
+	}
+	close(ch)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if n := blockDirs(t, dir); n != 4 {
+		t.Errorf("%d blocks in the output directory, expected 4", n)
+	}
+	if _, err := os.Stat(staging); !os.IsNotExist(err) {
+		t.Errorf("the staging directory is left: %v", err)
+	}
+}
+
+func TestAtomicOutputFailure(t *testing.T) {
+	hour := int64(time.Hour / time.Millisecond)
+	tables := []interface{}{
+		[]Sample{gauge("m", 0, 1)},
+		[]Sample{gauge("m", hour, 2)},
+		[]Sample{gauge("m", 2*hour, 3)},
+		[]Sample{noName(2 * hour)}, // Fails the job
+	}
+	for _, atomic := range []AtomicOutput{AtomicOutputBlock, AtomicOutputJob} {
+		t.Run(string(atomic), func(t *testing.T) {
+			dir := t.TempDir()
+			_, err := runTestJob(t, Options{OutputDir: dir, BlockDuration: time.Hour, StoreThreshold: 1,
+				MaxParallelConsumes: 1, LatePolicy: LateDrop, AtomicOutput: atomic}, tables...)
+			if err == nil {
+				t.Fatal("the job didn't fail")
+			}
+			if _, err := os.Stat(filepath.Join(dir, stagingDirName)); !os.IsNotExist(err) {
+				t.Errorf("the staging directory is left: %v", err)
+			}
+			// Each block is moved into place once flushed with the per-block atomic output
+			if n := blockDirs(t, dir); atomic == AtomicOutputJob && n != 0 || atomic == AtomicOutputBlock && n != 3 {
+				t.Errorf("%d blocks in the output directory", n)
+			}
+		})
+	}
+}
+
+func TestVerificationFailureRemovesBlock(t *testing.T) {
+	for _, atomic := range []AtomicOutput{AtomicOutputNone, AtomicOutputBlock} {
+		t.Run(string(atomic), func(t *testing.T) {
+			dir := t.TempDir()
+			bh, err := New(nil, Options{OutputDir: dir, VerifyBlocks: true, AtomicOutput: atomic})
+			if err != nil {
+				t.Fatal(err)
+			}
+			p, err := bh.newWriterPool(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			w, err := tsdb.NewBlockWriter(log.NewNopLogger(), p.dir, 2*bh.blockDuration)
+			if err != nil {
+				t.Fatal(err)
+			}
+			id := writeTestBlock(t, w, map[string]int{"m": 2})
+			// One more sample appended than written
+			if err := bh.onBlockFlushed(p, id, &blockStats{series: 1, samples: 3, mint: 0, maxt: 1000}); err == nil {
+				t.Fatal("the block has been verified")
+			}
+			if len(bh.Errors()) != 1 {
+				t.Errorf("errors %v, expected the verification one", bh.Errors())
+			}
+			if blockDirs(t, dir) != 0 || blockDirs(t, p.dir) != 0 {
+				t.Error("the block failing the verification is left")
+			}
+		})
+	}
+}
@@ -0,0 +1,252 @@
+package prometheus_backfill
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"github.com/go-kit/kit/log"
+	"github.com/oklog/ulid"
+	labels2 "github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/tsdb"
+	"github.com/prometheus/prometheus/tsdb/chunkenc"
+	"github.com/prometheus/prometheus/tsdb/chunks"
+	"github.com/prometheus/prometheus/tsdb/fileutil"
+	"github.com/prometheus/prometheus/tsdb/index"
+	"github.com/prometheus/prometheus/tsdb/tombstones"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// samplesPerChunk is the number of samples after which a chunk is cut, as the tsdb head does
+const samplesPerChunk = 120
+
+// blockWriter is implemented by tsdb.BlockWriter and by streamBlockWriter
+type blockWriter interface {
+	Appender(ctx context.Context) storage.Appender
+	Flush(ctx context.Context) (ulid.ULID, error)
+	Close() error
+}
+
+type streamSeries struct {
+	labels  labels2.Labels
+	chunks  []chunks.Meta // Chunks already written: only references and time ranges are kept in memory
+	chunk   *chunkenc.XORChunk
+	app     chunkenc.Appender
+	mint    int64 // Min time of the open chunk
+	maxt    int64 // Time of the last sample appended to the series
+	samples uint64
+}
+
+// streamBlockWriter writes a block without the in-memory tsdb head: the samples are appended to the open chunk of
+// their series and every chunk is written to disk with the tsdb chunks writer once it is full. The index is written
+// by the tsdb index writer when the block is flushed, so the memory used is proportional to the number of the series,
+// not to the number of the samples in the block.
+// The samples of each series have to be appended in time order: older samples are rejected with
+// storage.ErrOutOfOrderSample (the writer pool appends the samples of each range in time order).
+// Like tsdb.BlockWriter, it does not check if the target directory exists or contains overlapping blocks.
+type streamBlockWriter struct {
+	dir        string
+	tmp        string // Block directory until the block is flushed
+	ulid       ulid.ULID
+	chunkw     *chunks.Writer
+	series     []*streamSeries
+	refs       map[uint64][]uint64 // Labels hash => series references (index in series + 1)
+	mint, maxt int64
+}
+
+func newStreamBlockWriter(dir string) (*streamBlockWriter, error) {
+	id := ulid.MustNew(ulid.Now(), rand.Reader)
+	w := &streamBlockWriter{
+		dir:  dir,
+		tmp:  filepath.Join(dir, id.String()+".tmp-for-creation"),
+		ulid: id,
+		refs: make(map[uint64][]uint64),
+		mint: math.MaxInt64,
+		maxt: math.MinInt64,
+	}
+	if err := os.MkdirAll(w.tmp, 0777); err != nil {
+		return nil, err
+	}
+	chunkw, err := chunks.NewWriter(filepath.Join(w.tmp, "chunks"))
+	if err != nil {
+		return nil, err
+	}
+	w.chunkw = chunkw
+	return w, nil
+}
+
+// Appender returns the writer itself: it is not thread-safe, the handler uses it with the writerLock
+func (w *streamBlockWriter) Appender(context.Context) storage.Appender {
+	return w
+}
+
+func (w *streamBlockWriter) Add(l labels2.Labels, t int64, v float64) (uint64, error) {
+	hash := l.Hash()
+	for _, ref := range w.refs[hash] {
+		if labels2.Equal(w.series[ref-1].labels, l) {
+			return ref, w.AddFast(ref, t, v)
+		}
+	}
+	w.series = append(w.series, &streamSeries{labels: l.Copy(), maxt: math.MinInt64})
+	ref := uint64(len(w.series))
+	w.refs[hash] = append(w.refs[hash], ref)
+	return ref, w.AddFast(ref, t, v)
+}
+
+func (w *streamBlockWriter) AddFast(ref uint64, t int64, v float64) error {
+	if ref == 0 || ref > uint64(len(w.series)) {
+		return storage.ErrNotFound
+	}
+	s := w.series[ref-1]
+	switch {
+	case t == s.maxt:
+		return storage.ErrDuplicateSampleForTimestamp
+	case t < s.maxt:
+		return storage.ErrOutOfOrderSample
+	}
+	if s.chunk == nil {
+		s.chunk = chunkenc.NewXORChunk()
+		app, err := s.chunk.Appender()
+		if err != nil {
+			return err
+		}
+		s.app = app
+		s.mint = t
+	}
+	s.app.Append(t, v)
+	s.maxt = t
+	s.samples++
+	if t < w.mint {
+		w.mint = t
+	}
+	if t > w.maxt {
+		w.maxt = t
+	}
+	if s.chunk.NumSamples() >= samplesPerChunk {
+		return w.cut(s)
+	}
+	return nil
+}
+
+// cut writes the open chunk of the series to disk
+func (w *streamBlockWriter) cut(s *streamSeries) error {
+	if s.chunk == nil {
+		return nil
+	}
+	metas := []chunks.Meta{{
+		Chunk:   s.chunk,
+		MinTime: s.mint,
+		MaxTime: s.maxt,
+	}}
+	if err := w.chunkw.WriteChunks(metas...); err != nil { // It sets the reference of the written chunk
+		return err
+	}
+	metas[0].Chunk = nil
+	s.chunks = append(s.chunks, metas[0])
+	s.chunk, s.app = nil, nil
+	return nil
+}
+
+// Commit is a no-op: samples are appended as soon as they are added
+func (w *streamBlockWriter) Commit() error {
+	return nil
+}
+
+func (w *streamBlockWriter) Rollback() error {
+	return errors.New("rollback is not supported by the streaming block writer")
+}
+
+// Flush writes the remaining chunks, the index and the meta file and moves the block in the destination directory
+func (w *streamBlockWriter) Flush(ctx context.Context) (ulid.ULID, error) {
+	if len(w.series) == 0 {
+		return ulid.ULID{}, tsdb.ErrNoSeriesAppended
+	}
+	stats := tsdb.BlockStats{NumSeries: uint64(len(w.series))}
+	for _, s := range w.series {
+		if err := w.cut(s); err != nil {
+			return ulid.ULID{}, err
+		}
+		stats.NumSamples += s.samples
+		stats.NumChunks += uint64(len(s.chunks))
+	}
+	if err := w.chunkw.Close(); err != nil {
+		return ulid.ULID{}, err
+	}
+	w.chunkw = nil
+
+	sort.Slice(w.series, func(i, j int) bool {
+		return labels2.Compare(w.series[i].labels, w.series[j].labels) < 0
+	})
+	symbols := make(map[string]struct{})
+	for _, s := range w.series {
+		for _, l := range s.labels {
+			symbols[l.Name] = struct{}{}
+			symbols[l.Value] = struct{}{}
+		}
+	}
+	sortedSymbols := make([]string, 0, len(symbols))
+	for sym := range symbols {
+		sortedSymbols = append(sortedSymbols, sym)
+	}
+	sort.Strings(sortedSymbols)
+
+	indexw, err := index.NewWriter(ctx, filepath.Join(w.tmp, "index"))
+	if err != nil {
+		return ulid.ULID{}, err
+	}
+	for _, sym := range sortedSymbols {
+		if err := indexw.AddSymbol(sym); err != nil {
+			_ = indexw.Close()
+			return ulid.ULID{}, err
+		}
+	}
+	for i, s := range w.series {
+		if err := indexw.AddSeries(uint64(i), s.labels, s.chunks...); err != nil {
+			_ = indexw.Close()
+			return ulid.ULID{}, err
+		}
+	}
+	if err := indexw.Close(); err != nil {
+		return ulid.ULID{}, err
+	}
+
+	meta := &tsdb.BlockMeta{
+		ULID:    w.ulid,
+		MinTime: w.mint,
+		// Block intervals are half-open: [b.MinTime, b.MaxTime)
+		MaxTime: w.maxt + 1,
+		Stats:   stats,
+		Compaction: tsdb.BlockMetaCompaction{
+			Level:   1,
+			Sources: []ulid.ULID{w.ulid},
+		},
+		Version: 1,
+	}
+	metaJSON, err := json.MarshalIndent(meta, "", "\t")
+	if err != nil {
+		return ulid.ULID{}, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(w.tmp, "meta.json"), metaJSON, 0666); err != nil {
+		return ulid.ULID{}, err
+	}
+	if _, err := tombstones.WriteFile(log.NewNopLogger(), w.tmp, tombstones.NewMemTombstones()); err != nil {
+		return ulid.ULID{}, err
+	}
+	if err := fileutil.Replace(w.tmp, filepath.Join(w.dir, w.ulid.String())); err != nil {
+		return ulid.ULID{}, err
+	}
+	return w.ulid, nil
+}
+
+// Close removes the block directory if the block has not been flushed
+func (w *streamBlockWriter) Close() error {
+	if w.chunkw != nil {
+		_ = w.chunkw.Close()
+	}
+	return os.RemoveAll(w.tmp)
+}
@@ -0,0 +1,130 @@
+package prometheus_backfill
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-kit/kit/log"
+	"github.com/oklog/ulid"
+	labels2 "github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/tsdb"
+	"github.com/prometheus/prometheus/tsdb/chunks"
+	"github.com/prometheus/prometheus/tsdb/index"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// writeTestBlock appends the samples of the series (each one with n samples, one per second) to w and flushes it
+func writeTestBlock(t *testing.T, w blockWriter, series map[string]int) ulid.ULID {
+	t.Helper()
+	app := w.Appender(context.Background())
+	for name, n := range series {
+		lset := labels2.FromStrings("__name__", name, "n", fmt.Sprint(n))
+		for i := 0; i < n; i++ {
+			if _, err := app.Add(lset, int64(i)*1000, float64(i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := app.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	id, err := w.Flush(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+// blockChunks returns the number of chunks of each series of the block
+func blockChunks(t *testing.T, b *tsdb.Block) map[string]int {
+	t.Helper()
+	ir, err := b.Index()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ir.Close()
+	p, err := ir.Postings(index.AllPostingsKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := make(map[string]int)
+	for p.Next() {
+		var lset labels2.Labels
+		var chks []chunks.Meta
+		if err := ir.Series(p.At(), &lset, &chks); err != nil {
+			t.Fatal(err)
+		}
+		counts[lset.String()] = len(chks)
+	}
+	if err := p.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return counts
+}
+
+func TestStreamBlockWriterMatchesBlockWriter(t *testing.T) {
+	// Series around the samplesPerChunk boundary
+	series := map[string]int{"a": 1, "b": samplesPerChunk - 1, "c": samplesPerChunk, "d": samplesPerChunk + 1,
+		"e": 2 * samplesPerChunk, "f": 2*samplesPerChunk + 1}
+	dir := t.TempDir()
+	sw, err := newStreamBlockWriter(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	streamID := writeTestBlock(t, sw, series)
+	bw, err := tsdb.NewBlockWriter(log.NewNopLogger(), dir, 2*3600*1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	headID := writeTestBlock(t, bw, series)
+
+	blocks := make([]*tsdb.Block, 2)
+	for i, id := range []ulid.ULID{streamID, headID} {
+		b, err := tsdb.OpenBlock(log.NewNopLogger(), filepath.Join(dir, id.String()), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer b.Close()
+		if err := verifyIndex(b); err != nil {
+			t.Errorf("block %s: %v", id, err)
+		}
+		blocks[i] = b
+	}
+	stream, head := blocks[0].Meta(), blocks[1].Meta()
+	stream.Stats.NumChunks, head.Stats.NumChunks = 0, 0 // The head predicts the end of the chunks from their first samples
+	if stream.MinTime != head.MinTime || stream.MaxTime != head.MaxTime || stream.Stats != head.Stats {
+		t.Errorf("meta %d-%d %+v, tsdb.BlockWriter %d-%d %+v", stream.MinTime, stream.MaxTime, stream.Stats,
+			head.MinTime, head.MaxTime, head.Stats)
+	}
+	streamSeries := readTestSeries(t, blocks[0])
+	if h := readTestSeries(t, blocks[1]); !reflect.DeepEqual(streamSeries, h) {
+		t.Errorf("series %v, tsdb.BlockWriter %v", streamSeries, h)
+	}
+	for lset, n := range blockChunks(t, blocks[0]) {
+		samples := len(streamSeries[lset])
+		if expected := (samples + samplesPerChunk - 1) / samplesPerChunk; n != expected {
+			t.Errorf("%s: %d chunks for %d samples, expected %d", lset, n, samples, expected)
+		}
+	}
+}
+
+func TestStreamBlockWriterRejectsOutOfOrder(t *testing.T) {
+	w, err := newStreamBlockWriter(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	app := w.Appender(context.Background())
+	lset := labels2.FromStrings("__name__", "m")
+	if _, err := app.Add(lset, 2000, 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := app.Add(lset, 1000, 1); err != storage.ErrOutOfOrderSample {
+		t.Errorf("error %v, expected %v", err, storage.ErrOutOfOrderSample)
+	}
+}
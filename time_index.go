@@ -0,0 +1,46 @@
+package prometheus_backfill
+
+import (
+	io_prometheus_client "github.com/prometheus/client_model/go"
+	"sort"
+)
+
+// timeIndex groups the rows by timestamp (the one of their first metric) in buckets.
+// Insertion is O(1) whatever the order of the input is (time-ordered, reverse-ordered or random) and the in-order
+// visit only sorts the distinct timestamps, O(n + k log k) for n rows with k distinct timestamps.
+type timeIndex struct {
+	buckets map[int64][][]*io_prometheus_client.Metric
+	length  int64 // Number of inserted rows
+}
+
+func newTimeIndex() *timeIndex {
+	return &timeIndex{
+		buckets: make(map[int64][][]*io_prometheus_client.Metric),
+	}
+}
+
+func (t *timeIndex) insert(v []*io_prometheus_client.Metric) {
+	if len(v) == 0 {
+		ErrLog("Tried insertion of an empty slice")
+		return // No insert for empty slices
+	}
+	ts := *v[0].TimestampMs
+	t.buckets[ts] = append(t.buckets[ts], v)
+	t.length++
+}
+
+// inorder visits the rows by ascending timestamp; rows with the same timestamp are visited by arrival order
+func (t *timeIndex) inorder(visit func(metric []*io_prometheus_client.Metric)) {
+	timestamps := make([]int64, 0, len(t.buckets))
+	for ts := range t.buckets {
+		timestamps = append(timestamps, ts)
+	}
+	sort.Slice(timestamps, func(i, j int) bool {
+		return timestamps[i] < timestamps[j]
+	})
+	for _, ts := range timestamps {
+		for _, row := range t.buckets[ts] {
+			visit(row)
+		}
+	}
+}
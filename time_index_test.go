@@ -0,0 +1,84 @@
+package prometheus_backfill
+
+import (
+	io_prometheus_client "github.com/prometheus/client_model/go"
+	"math/rand"
+	"testing"
+)
+
+// indexRow returns a row of a single metric at ts, with the value v
+func indexRow(ts int64, v float64) []*io_prometheus_client.Metric {
+	return []*io_prometheus_client.Metric{{TimestampMs: &ts, Gauge: &io_prometheus_client.Gauge{Value: &v}}}
+}
+
+func TestTimeIndexInorder(t *testing.T) {
+	index := newTimeIndex()
+	r := rand.New(rand.NewSource(1))
+	const n = 1000
+	for i := 0; i < n; i++ {
+		index.insert(indexRow(r.Int63n(100), float64(i)))
+	}
+	if index.length != n {
+		t.Fatalf("length %d, expected %d", index.length, n)
+	}
+	visited := 0
+	var lastTs int64 = -1
+	var lastValue float64 = -1
+	index.inorder(func(row []*io_prometheus_client.Metric) {
+		visited++
+		ts, v := *row[0].TimestampMs, row[0].Gauge.GetValue()
+		switch {
+		case ts < lastTs:
+			t.Fatalf("row at %d visited after a row at %d", ts, lastTs)
+		case ts == lastTs && v < lastValue:
+			t.Fatalf("rows at %d not visited by arrival order: %v after %v", ts, v, lastValue)
+		}
+		lastTs, lastValue = ts, v
+	})
+	if visited != n {
+		t.Errorf("%d rows visited, expected %d", visited, n)
+	}
+}
+
+func benchmarkTimeIndex(b *testing.B, timestamps []int64) {
+	rows := make([][]*io_prometheus_client.Metric, len(timestamps))
+	for i, ts := range timestamps {
+		rows[i] = indexRow(ts, 1)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		index := newTimeIndex()
+		for _, row := range rows {
+			index.insert(row)
+		}
+		index.inorder(func([]*io_prometheus_client.Metric) {})
+	}
+}
+
+const benchmarkIndexRows = 100000
+
+func BenchmarkTimeIndexSorted(b *testing.B) {
+	timestamps := make([]int64, benchmarkIndexRows)
+	for i := range timestamps {
+		timestamps[i] = int64(i) * 1000
+	}
+	benchmarkTimeIndex(b, timestamps)
+}
+
+func BenchmarkTimeIndexReverse(b *testing.B) {
+	timestamps := make([]int64, benchmarkIndexRows)
+	for i := range timestamps {
+		timestamps[i] = int64(len(timestamps)-i) * 1000
+	}
+	benchmarkTimeIndex(b, timestamps)
+}
+
+func BenchmarkTimeIndexRandom(b *testing.B) {
+	r := rand.New(rand.NewSource(1))
+	timestamps := make([]int64, benchmarkIndexRows)
+	for i := range timestamps {
+		timestamps[i] = r.Int63n(benchmarkIndexRows) * 1000
+	}
+	benchmarkTimeIndex(b, timestamps)
+}
@@ -1,13 +1,16 @@
 package prometheus_backfill
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"github.com/go-kit/kit/log"
+	"github.com/oklog/ulid"
 	io_prometheus_client "github.com/prometheus/client_model/go"
 	labels2 "github.com/prometheus/prometheus/pkg/labels"
 	"github.com/prometheus/prometheus/tsdb"
-	"math"
+	"os"
 	"sort"
-	"time"
 )
 
 type auxStoreStruct struct {
@@ -16,19 +19,22 @@ type auxStoreStruct struct {
 }
 
 // [CONCUR] Launch the store in tsdb as a go routine
-func (bh *backfillHandler) checkAndStore(force bool) {
-	bh.bstLock.Lock()
-	if !force && bh.bst.length < bh.storeThreshold {
-		bh.bstLock.Unlock()
+func (bh *Handler) checkAndStore(force bool) {
+	if bh.failed.Load() {
 		return
 	}
-	oldBst := bh.bst
-	bh.bst = new(bst)
-	bh.bstLock.Unlock()
-	// Notice2("BST swap done: ", oldBst.length, "metrics to store. Store in appender...")
+	bh.indexLock.Lock()
+	if !force && bh.index.length < bh.storeThreshold {
+		bh.indexLock.Unlock()
+		return
+	}
+	oldIndex := bh.index
+	bh.index = newTimeIndex()
+	bh.indexLock.Unlock()
+	// Notice2("Time index swap done: ", oldIndex.length, "metrics to store. Store in appender...")
 	counter := 0
 	var toStore []auxStoreStruct
-	oldBst.inorder(func(metric []*io_prometheus_client.Metric) {
+	oldIndex.inorder(func(metric []*io_prometheus_client.Metric) {
 		// Each metric array reports the same timestamp with different labels,
 		// Need group by name
 		for _, m := range metric {
@@ -51,72 +57,165 @@ func (bh *backfillHandler) checkAndStore(force bool) {
 		}
 	})
 
-	bh.writerLock.Lock()
-	for _, m := range toStore {
-		bh.store(&m)
+	if bh.spillDir != "" {
+		if err := bh.spill(toStore); err != nil {
+			bh.fail(err)
+			return
+		}
+		if force {
+			bh.writerLock.Lock()
+			if err := bh.mergeAndStore(); err != nil {
+				bh.fail(err)
+			}
+			bh.writerLock.Unlock()
+		}
+		return
 	}
+	bh.writerLock.Lock()
+	bh.storeBatch(toStore)
 	bh.writerLock.Unlock()
 	//	Notice3("Saved", counter, "saved into tsdb appender of which length is:", bh.counter)
 }
 
-func (bh *backfillHandler) store(m *auxStoreStruct) {
-	switch {
-	case m.metric.Gauge != nil:
-		bh.toTsdb(m.metric, m.metric.Gauge.Value, m.labels)
-	default: // TODO
-		panic("implement me")
+// storeBatch is not thread-safe! Use with the writerLock
+func (bh *Handler) storeBatch(toStore []auxStoreStruct) {
+	for _, m := range toStore {
+		if bh.failed.Load() {
+			return
+		}
+		bh.store(&m)
+	}
+	if bh.latePolicy != "" {
+		if err := bh.writers.flushClosed(); err != nil {
+			bh.fail(err)
+		}
 	}
 }
 
-func (bh *backfillHandler) toTsdb(m *io_prometheus_client.Metric, v *float64, labels []labels2.Label) {
+func (bh *Handler) store(m *auxStoreStruct) {
+	if m.metric.Gauge == nil && m.metric.Counter == nil { // TODO
+		bh.rowError(&AppendError{
+			Labels:    m.labels,
+			Timestamp: *m.metric.TimestampMs,
+			Value:     sampleValue(m.metric),
+			Err:       errors.New("unsupported metric type"),
+		}, nil)
+		return
+	}
+	bh.toTsdb(m)
+}
 
-	// bh.writerLock.Lock()
-	if bh.minTime == math.MaxInt64 {
-		// Putting first metric, the appender will set its lower bound timestamp
-		bh.minTime = *m.TimestampMs
-	}
-	if bh.minTime != math.MaxInt64 && !(bh.minTime <= *m.TimestampMs && *m.TimestampMs <= (bh.minTime+(bh.blockDuration*1000))) {
-		// current time stamp is not in the appender allowed range. Creating a new block
-		Notice3("Not within the allowed time-interval range",
-			time.Unix(bh.minTime/1000, 0), "<=",
-			time.Unix(*m.TimestampMs/1000, 0).String(), "<=",
-			time.Unix((bh.minTime+bh.blockDuration)/1000, 0).String(), "blockDuration (ms): ",
-			bh.blockDuration)
-		bh.setBlockWriter()
-		bh.minTime = *m.TimestampMs
-	}
-	if _, err := bh.appender.Add(labels, *m.TimestampMs, *v); err != nil {
-		ErrLog("Error appending metric", m.String()[0:100], err, '\n')
-	}
-	bh.counter++
-	if bh.counter >= bh.maxPerAppender {
-		Notice("Flushing appender (writes on Disk)...")
-		bh.setBlockWriter()
-		bh.counter = 0
-		bh.minTime = math.MaxInt64
+func (bh *Handler) toTsdb(m *auxStoreStruct) {
+	t := *m.metric.TimestampMs
+	if len(bh.protectedRanges) > 0 && timeRangesContain(bh.protectedRanges, t) {
+		bh.protectedSamples.Inc()
+		return
+	}
+	if bh.isCovered(m.labels, t) {
+		bh.skippedSamples.Inc()
+		return
+	}
+	var err error
+	if bh.isLate(t) {
+		err = bh.storeLate(m)
+	} else {
+		err = bh.writers.add(m)
 	}
+	if err == nil {
+		return
+	}
+	if errors.Is(err, ErrLateSample) {
+		bh.deadLetter(err, nil)
+	}
+	bh.fail(err)
 }
 
-// setBlockWriter is not thread-safe! Use with the writerLock
-func (bh *backfillHandler) setBlockWriter() {
-	if bh.blockWriter != nil && bh.appender != nil {
-		bh.flushBlockWriter()
+// appendError reports the error of a sample rejected by a block writer
+func (bh *Handler) appendError(m *auxStoreStruct, err error) {
+	bh.rowError(&AppendError{Labels: m.labels, Timestamp: *m.metric.TimestampMs, Value: sampleValue(m.metric),
+		Err: err}, nil)
+}
+
+func sampleValue(m *io_prometheus_client.Metric) float64 {
+	switch {
+	case m.Gauge != nil:
+		return m.Gauge.GetValue()
+	case m.Counter != nil:
+		return m.Counter.GetValue()
+	default:
+		return m.GetUntyped().GetValue()
 	}
-	bh.blockWriter, _ = tsdb.NewBlockWriter(log.NewNopLogger(), bh.outputDir, bh.blockDuration)
-	bh.appender = bh.blockWriter.Appender(bh.ctx)
 }
 
-// flushBlockWriter is not thread-safe! Use with the writerLock
-func (bh *backfillHandler) flushBlockWriter() {
-	if err := bh.appender.Commit(); err != nil {
-		ErrLog("Error on appender commit: ", bh.appender, bh.blockWriter)
+// newWriterPool creates the writer pool for the blocks of outputDir, cleaning up the data left there by previous runs
+// and resuming the blocks committed by the checkpoint, if any
+func (bh *Handler) newWriterPool(outputDir string) (*writerPool, error) {
+	dir := bh.writeDir(outputDir)
+	var committed []ulid.ULID
+	keep := make(map[string]bool)
+	if bh.checkpoint != nil {
+		var err error
+		blocksDir := outputDir
+		if bh.atomicOutput == AtomicOutputJob {
+			blocksDir = dir
+		}
+		if committed, err = bh.checkpoint.resume(outputDir, blocksDir); err != nil {
+			return nil, fmt.Errorf("unable to resume the blocks of %s from the checkpoint: %w", outputDir, err)
+		}
+		for _, id := range committed {
+			keep[id.String()] = true
+		}
+	}
+	if err := cleanupOutputDir(outputDir, keep); err != nil {
+		return nil, fmt.Errorf("unable to clean up the output directory %s: %w", outputDir, err)
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, err
+	}
+	// Blocks are flushed even when the job is cancelled
+	p := newWriterPool(context.Background(), dir, outputDir, bh.spillDir, bh.blockDuration, bh.maxOpenWriters,
+		bh.maxPerAppender, bh.newBlockWriter)
+	p.prepare = func(samples []auxStoreStruct) []auxStoreStruct {
+		return bh.aggregate(bh.deduplicate(samples))
 	}
-	ulid, err := bh.blockWriter.Flush(bh.ctx)
+	if outputDir != bh.lateOutputDir {
+		p.closed = bh.isClosed
+	}
+	p.onAppendError = bh.appendError
+	p.onFlush = bh.onBlockFlushed
+	p.flushed = committed
+	return p, nil
+}
+
+// closePool flushes all the ranges of the pool and finalizes its blocks
+func (bh *Handler) closePool(p *writerPool) {
+	err := p.flushAll()
+	p.close()
 	if err != nil {
-		ErrLog("Error flushing block", ulid, err)
+		bh.fail(err)
+	} else if !bh.failed.Load() && !bh.cancelled.Load() {
+		bh.compact(p)
 	}
-	if err := bh.blockWriter.Close(); err != nil {
-		ErrLog("Error closing block", ulid, err)
+	bh.promoteAll(p)
+	if p.dir == p.outputDir {
+		return
+	}
+	if bh.checkpoint == nil && (len(bh.Errors()) > 0 || bh.cancelled.Load()) {
+		// The blocks of an incomplete job can't be resumed
+		if err := os.RemoveAll(p.dir); err != nil {
+			ErrLog("Error removing the staging directory %s: %v\n", p.dir, err)
+		}
+		return
+	}
+	_ = os.Remove(p.dir) // Only if empty: the blocks of an incomplete job are left to resume it
+
+}
+
+func (bh *Handler) newBlockWriter(dir string) (blockWriter, error) {
+	if bh.streamingWriter {
+		return newStreamBlockWriter(dir)
 	}
-	Notice3("Block written, flushed (new appender)", ulid.String())
+	// The head of the block writer rejects the samples older than its max time minus half of its block size: the
+	// doubled size lets it accept all the samples of an aligned range.
+	return tsdb.NewBlockWriter(log.NewNopLogger(), dir, 2*bh.blockDuration)
 }
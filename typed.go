@@ -0,0 +1,43 @@
+package prometheus_backfill
+
+import (
+	"context"
+	"reflect"
+)
+
+// TypedHandler is a Handler consuming tables of rows of type T (a struct or a pointer to a struct, with the prometheus
+// tags). The schema of T is compiled and validated once, when the handler is created, so that model mistakes are
+// reported before the job starts instead of on each row.
+type TypedHandler[T any] struct {
+	*Handler
+	in <-chan []T
+}
+
+// NewHandler creates a TypedHandler writing the tables sent to ch into blocks. It returns a *SchemaError if the rows
+// of type T can't be converted into samples.
+// Offsets (see SourceOffset) can't be reported on a typed channel: use New for checkpointed jobs.
+func NewHandler[T any](ch <-chan []T, opts Options) (*TypedHandler[T], error) {
+	h, err := New(make(chan interface{}, cap(ch)), opts)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := h.schemaFor(reflect.TypeOf((*T)(nil)).Elem()); err != nil {
+		return nil, err
+	}
+	return &TypedHandler[T]{Handler: h, in: ch}, nil
+}
+
+// RunJob consumes the tables sent to the typed channel until it is closed, as Handler.RunJob
+func (h *TypedHandler[T]) RunJob(ctx context.Context) error {
+	go func() {
+		for table := range h.in {
+			select {
+			case h.ch <- table:
+			case <-ctx.Done():
+				return // The handler stops consuming on its own
+			}
+		}
+		close(h.ch)
+	}()
+	return h.Handler.RunJob(ctx)
+}
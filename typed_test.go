@@ -0,0 +1,118 @@
+package prometheus_backfill
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+type labeledRow struct {
+	Timestamp int64
+	Usage     float64 `prometheus:"metric_type:counter,host:h"`
+	ID        string
+}
+
+func (r labeledRow) GetAdditionalLabels() map[string]string {
+	return map[string]string{"id": r.ID}
+}
+
+type badLabelsRow struct {
+	Timestamp int64
+	Usage     float64 `prometheus:"metric_type:gauge"`
+}
+
+func (badLabelsRow) GetAdditionalLabels() map[string]interface{} {
+	return nil
+}
+
+type labelsWithArgsRow struct {
+	Timestamp int64
+	Usage     float64 `prometheus:"metric_type:gauge"`
+}
+
+func (labelsWithArgsRow) GetAdditionalLabels(string) map[string]string {
+	return nil
+}
+
+type noTimestampRow struct {
+	Usage float64 `prometheus:"metric_type:gauge"`
+}
+
+type unknownTypeRow struct {
+	Timestamp int64
+	Usage     float64 `prometheus:"metric_type:histogram"`
+}
+
+func TestNewHandler(t *testing.T) {
+	dir := t.TempDir()
+	ch := make(chan []*labeledRow)
+	h, err := NewHandler[*labeledRow](ch, Options{OutputDir: dir, BlockDuration: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		ch <- []*labeledRow{{Timestamp: 1, Usage: 1, ID: "a"}, {Timestamp: 2, Usage: 2, ID: "a"}}
+		ch <- []*labeledRow{{Timestamp: 1, Usage: 5, ID: "b"}}
+		close(ch)
+	}()
+	if err := h.RunJob(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	blocks := readTestBlocks(t, dir)
+	if len(blocks) != 1 {
+		t.Fatalf("%d blocks, expected 1", len(blocks))
+	}
+	expected := map[string][]testSample{
+		`{__name__="Usage_total", host="h", id="a"}`: {{1000, 1}, {2000, 2}},
+		`{__name__="Usage_total", host="h", id="b"}`: {{1000, 5}},
+	}
+	for series, samples := range expected {
+		got := blocks[0].series[series]
+		if len(got) != len(samples) {
+			t.Errorf("series %s: %v, expected %v (series: %v)", series, got, samples, blocks[0].series)
+			continue
+		}
+		for i := range samples {
+			if got[i] != samples[i] {
+				t.Errorf("series %s: %v, expected %v", series, got, samples)
+			}
+		}
+	}
+}
+
+func TestNewHandlerSchemaErrors(t *testing.T) {
+	opts := Options{OutputDir: t.TempDir()}
+	tests := []struct {
+		name string
+		new  func() error
+	}{
+		{"additional labels type", func() error {
+			_, err := NewHandler[badLabelsRow](make(chan []badLabelsRow), opts)
+			return err
+		}},
+		{"additional labels arguments", func() error {
+			_, err := NewHandler[labelsWithArgsRow](make(chan []labelsWithArgsRow), opts)
+			return err
+		}},
+		{"no timestamp", func() error {
+			_, err := NewHandler[noTimestampRow](make(chan []noTimestampRow), opts)
+			return err
+		}},
+		{"unknown metric type", func() error {
+			_, err := NewHandler[*unknownTypeRow](make(chan []*unknownTypeRow), opts)
+			return err
+		}},
+		{"not a struct", func() error {
+			_, err := NewHandler[int](make(chan []int), opts)
+			return err
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.new(); !errors.As(err, new(*SchemaError)) {
+				t.Errorf("error %v, expected a schema error", err)
+			}
+		})
+	}
+}
@@ -12,6 +12,9 @@ var (
 	Notice4 = color.New(color.FgYellow).PrintlnFunc()
 )
 
+// Must logs the error with errString and panics, if err is not nil.
+//
+// Deprecated: handle the errors, the functions of this package don't panic on invalid input.
 func Must(err error, errString string) {
 	if err != nil {
 		ErrLog("%v\n%v\n", err, errString)
@@ -0,0 +1,145 @@
+package prometheus_backfill
+
+import (
+	"fmt"
+	"github.com/go-kit/kit/log"
+	"github.com/oklog/ulid"
+	labels2 "github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/tsdb"
+	"github.com/prometheus/prometheus/tsdb/chunks"
+	"github.com/prometheus/prometheus/tsdb/index"
+	"os"
+	"path/filepath"
+)
+
+// reportError records an error of the job. It is thread-safe
+func (bh *Handler) reportError(err error) {
+	ErrLog("%v\n", err)
+	bh.errorsLock.Lock()
+	bh.errors = append(bh.errors, err)
+	bh.errorsLock.Unlock()
+}
+
+// Errors returns the errors of the job
+func (bh *Handler) Errors() []error {
+	bh.errorsLock.Lock()
+	defer bh.errorsLock.Unlock()
+	return append([]error(nil), bh.errors...)
+}
+
+// onBlockFlushed is called by the writer pools after each block is flushed: a block failing the verification is
+// discarded and removed, so that Prometheus never loads it. Verified blocks are moved into place for the per-block
+// atomic output and recorded by the checkpoint.
+func (bh *Handler) onBlockFlushed(p *writerPool, id ulid.ULID, stats *blockStats) error {
+	blockDir := filepath.Join(p.dir, id.String())
+	if bh.verifyBlocks {
+		if err := verifyBlock(blockDir, stats); err != nil {
+			err = fmt.Errorf("verification of block %s failed: %w", id, err)
+			bh.reportError(err)
+			if rerr := os.RemoveAll(blockDir); rerr != nil {
+				ErrLog("Unable to remove the block %s: %v\n", blockDir, rerr)
+			}
+			return err
+		}
+	}
+	if bh.atomicOutput == AtomicOutputBlock {
+		if err := promote(p, id); err != nil {
+			err = fmt.Errorf("unable to move block %s into place: %w", id, err)
+			bh.reportError(err)
+			return err
+		}
+	}
+	if bh.checkpoint != nil {
+		if err := bh.checkpoint.onBlockFlushed(p, id); err != nil {
+			bh.fail(err) // The block is kept, but it can't be removed when resuming
+		}
+	}
+	return nil
+}
+
+// verifyBlock checks the block in dir against the stats of the samples appended to it
+func verifyBlock(dir string, stats *blockStats) error {
+	b, err := tsdb.OpenBlock(log.NewNopLogger(), dir, nil)
+	if err != nil {
+		return err
+	}
+	defer b.Close()
+	meta := b.Meta()
+	switch {
+	case meta.Stats.NumSeries != uint64(stats.series):
+		return fmt.Errorf("%d series, %d appended", meta.Stats.NumSeries, stats.series)
+	case meta.Stats.NumSamples != uint64(stats.samples):
+		return fmt.Errorf("%d samples, %d appended", meta.Stats.NumSamples, stats.samples)
+	case meta.MinTime != stats.mint || meta.MaxTime != stats.maxt+1: // Block intervals are half-open
+		return fmt.Errorf("range [%d, %d), appended samples in [%d, %d]", meta.MinTime, meta.MaxTime, stats.mint,
+			stats.maxt)
+	}
+	return verifyIndex(b)
+}
+
+// verifyIndex checks that the series of the block are sorted, with valid labels, and that their chunks are sorted,
+// readable and within the block range. The samples in the chunks must match the block stats.
+func verifyIndex(b *tsdb.Block) error {
+	ir, err := b.Index()
+	if err != nil {
+		return err
+	}
+	defer ir.Close()
+	cr, err := b.Chunks()
+	if err != nil {
+		return err
+	}
+	defer cr.Close()
+
+	meta := b.Meta()
+	p, err := ir.Postings(index.AllPostingsKey())
+	if err != nil {
+		return err
+	}
+	var (
+		lset, last labels2.Labels
+		chks       []chunks.Meta
+		series     uint64
+		samples    uint64
+	)
+	for p.Next() {
+		if err := ir.Series(p.At(), &lset, &chks); err != nil {
+			return fmt.Errorf("series %d: %w", p.At(), err)
+		}
+		series++
+		if len(lset) == 0 || lset.Get(labels2.MetricName) == "" {
+			return fmt.Errorf("series %d has no metric name", p.At())
+		}
+		if n, dup := lset.HasDuplicateLabelNames(); dup {
+			return fmt.Errorf("series %s has duplicate label %s", lset, n)
+		}
+		if last != nil && labels2.Compare(last, lset) >= 0 {
+			return fmt.Errorf("series %s is out of order", lset)
+		}
+		last = lset.Copy()
+		if len(chks) == 0 {
+			return fmt.Errorf("series %s has no chunks", lset)
+		}
+		for i, c := range chks {
+			if c.MinTime > c.MaxTime || c.MinTime < meta.MinTime || c.MaxTime >= meta.MaxTime {
+				return fmt.Errorf("series %s has chunk [%d, %d] out of the block range", lset, c.MinTime, c.MaxTime)
+			}
+			if i > 0 && c.MinTime <= chks[i-1].MaxTime {
+				return fmt.Errorf("series %s has overlapping chunks", lset)
+			}
+			chk, err := cr.Chunk(c.Ref)
+			if err != nil {
+				return fmt.Errorf("series %s: %w", lset, err)
+			}
+			samples += uint64(chk.NumSamples())
+		}
+	}
+	if err := p.Err(); err != nil {
+		return err
+	}
+	if series != meta.Stats.NumSeries || samples != meta.Stats.NumSamples {
+		return fmt.Errorf("the index has %d series and %d samples, the meta %d and %d", series, samples,
+			meta.Stats.NumSeries, meta.Stats.NumSamples)
+	}
+	return nil
+}
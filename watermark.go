@@ -0,0 +1,85 @@
+package prometheus_backfill
+
+import (
+	"fmt"
+	"github.com/prometheus/prometheus/pkg/timestamp"
+	"math"
+	"path/filepath"
+	"time"
+)
+
+// LatePolicy tells what to do with the samples older than the watermark (the maximum timestamp seen minus the allowed
+// lateness)
+type LatePolicy string
+
+const (
+	LateDrop     LatePolicy = "drop"     // Drop the late samples, counting them
+	LateSeparate LatePolicy = "separate" // Write the late samples into a separate set of blocks
+	LateFail     LatePolicy = "fail"
+)
+
+func (p LatePolicy) validate() error {
+	switch p {
+	case LateDrop, LateSeparate, LateFail:
+		return nil
+	}
+	return fmt.Errorf("unknown late policy %s", p)
+}
+
+func (bh *Handler) setWatermark(allowedLateness time.Duration, policy LatePolicy, lateOutputDir string) {
+	if lateOutputDir == "" {
+		lateOutputDir = filepath.Join(bh.outputDir, "late")
+	}
+	bh.latePolicy = policy
+	bh.allowedLateness = int64(allowedLateness / time.Millisecond)
+	bh.lateOutputDir = lateOutputDir
+}
+
+// watermark returns the current watermark
+func (bh *Handler) watermark() int64 {
+	if bh.maxTime == math.MinInt64 {
+		return math.MinInt64
+	}
+	return bh.maxTime - bh.allowedLateness
+}
+
+// isLate updates the maximum timestamp seen and tells whether the sample is older than the watermark.
+// isLate is not thread-safe! Use with the writerLock
+func (bh *Handler) isLate(t int64) bool {
+	if bh.latePolicy == "" {
+		return false
+	}
+	if t > bh.maxTime {
+		bh.maxTime = t
+		return false
+	}
+	return t < bh.watermark()
+}
+
+// isClosed tells whether the block range starting at start is older than the watermark: its later samples are all
+// late, so its block can be written.
+// isClosed is not thread-safe! Use with the writerLock
+func (bh *Handler) isClosed(start int64) bool {
+	return bh.latePolicy != "" && bh.maxTime != math.MinInt64 && start+bh.blockDuration <= bh.watermark()
+}
+
+// storeLate applies the late policy to the sample.
+// storeLate is not thread-safe! Use with the writerLock
+func (bh *Handler) storeLate(m *auxStoreStruct) error {
+	bh.lateSamples.Inc()
+	switch bh.latePolicy {
+	case LateSeparate:
+		if bh.lateWriters == nil {
+			var err error
+			if bh.lateWriters, err = bh.newWriterPool(bh.lateOutputDir); err != nil {
+				return &FlushError{Dir: bh.lateOutputDir, Err: err}
+			}
+		}
+		return bh.lateWriters.add(m)
+	case LateFail:
+		return &AppendError{Labels: m.labels, Timestamp: *m.metric.TimestampMs, Value: sampleValue(m.metric),
+			Err: fmt.Errorf("%w: watermark is %s", ErrLateSample, timestamp.Time(bh.watermark()).UTC())}
+	default: // LateDrop
+		return nil
+	}
+}
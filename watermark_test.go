@@ -0,0 +1,81 @@
+package prometheus_backfill
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestLatePolicies(t *testing.T) {
+	hour := int64(time.Hour / time.Millisecond)
+	// Stored one table at a time: the third sample is older than the watermark (3h - 1h)
+	tables := []interface{}{
+		[]Sample{gauge("m", 0, 1)},
+		[]Sample{gauge("m", 3*hour, 2)},
+		[]Sample{gauge("m", hour/2, 3)},
+		[]Sample{gauge("m", 3*hour+1, 4)},
+	}
+	tests := []struct {
+		policy LatePolicy
+		fails  bool
+		late   []testSample // Samples of the late blocks
+	}{
+		{LateDrop, false, nil},
+		{LateSeparate, false, []testSample{{hour / 2, 3}}},
+		{LateFail, true, nil},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.policy), func(t *testing.T) {
+			dir, lateDir := t.TempDir(), t.TempDir()
+			bh, err := runTestJob(t, Options{
+				OutputDir:           dir,
+				BlockDuration:       time.Hour,
+				StoreThreshold:      1,
+				MaxParallelConsumes: 1,
+				LatePolicy:          tt.policy,
+				AllowedLateness:     time.Hour,
+				LateOutputDir:       lateDir,
+			}, tables...)
+			if tt.fails {
+				if !errors.Is(err, ErrLateSample) {
+					t.Fatalf("error %v, expected a late sample", err)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if n := bh.lateSamples.Load(); n != 1 {
+				t.Errorf("%d late samples, expected 1", n)
+			}
+			var samples []testSample
+			for _, b := range readTestBlocks(t, dir) {
+				samples = append(samples, b.series[`{__name__="m"}`]...)
+			}
+			expected := []testSample{{0, 1}, {3 * hour, 2}, {3*hour + 1, 4}}
+			if tt.fails {
+				expected = expected[:2] // The samples stored before the failure
+			}
+			if !equalTestSamples(samples, expected) {
+				t.Errorf("samples %v, expected %v", samples, expected)
+			}
+			var late []testSample
+			for _, b := range readTestBlocks(t, lateDir) {
+				late = append(late, b.series[`{__name__="m"}`]...)
+			}
+			if !equalTestSamples(late, tt.late) {
+				t.Errorf("late samples %v, expected %v", late, tt.late)
+			}
+		})
+	}
+}
+
+func equalTestSamples(a, b []testSample) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
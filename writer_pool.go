@@ -0,0 +1,333 @@
+package prometheus_backfill
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"github.com/oklog/ulid"
+	labels2 "github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/pkg/timestamp"
+	"io/ioutil"
+	"os"
+	"sort"
+)
+
+// defaultMaxOpenBlockWriters is the default number of block ranges that a pool keeps in memory at the same time
+const defaultMaxOpenBlockWriters = 4
+
+// rangeBuffer holds the samples of a single aligned block range until the range is flushed to its block
+type rangeBuffer struct {
+	start   int64            // Start of the aligned range
+	samples []auxStoreStruct // Samples in memory, in arrival order
+	runs    []string         // Run files of the samples spilled so far, in arrival order
+	elem    *list.Element    // Element in the LRU list, nil if no samples are in memory
+}
+
+// blockStats are the stats of the samples appended to a block, checked by the block verification
+type blockStats struct {
+	series  int
+	samples int64
+	mint    int64
+	maxt    int64
+}
+
+// writerPool buffers the samples of each aligned block range and writes every range to a single block when it is
+// flushed: the samples are appended in time order, so unordered input never produces overlapping blocks.
+// When more than maxOpen ranges would have samples in memory, or the samples in memory exceed maxSamples, the samples
+// of the least recently used range are spilled to a sorted run file, merged back when the range is flushed.
+// Ranges are flushed by flushAll, at the end of the job and at each checkpoint, or as soon as they are closed (no more
+// samples are expected for them, see Options.LatePolicy).
+// writerPool is not thread-safe! Use with the writerLock.
+type writerPool struct {
+	ctx           context.Context
+	dir           string // Where the blocks are written
+	outputDir     string // Where the blocks end up (it differs from dir for the atomic output)
+	spillDir      string // Where the run files are written, created by the first spill
+	tmpDir        string // Where the spillDir is created (os.TempDir() if empty)
+	blockDuration int64
+	maxOpen       int
+	maxSamples    int64
+	newWriter     func(dir string) (blockWriter, error)
+	ranges        map[int64]*rangeBuffer
+	lru           *list.List // Ranges with samples in memory, most recently used first
+	samples       int64      // Samples in memory
+	flushed       []ulid.ULID
+
+	// prepare resolves the samples of a range with the same timestamp before they are appended
+	prepare func(samples []auxStoreStruct) []auxStoreStruct
+	// onAppendError is called for the samples rejected by the block writer
+	onAppendError func(m *auxStoreStruct, err error)
+	// closed tells whether no more samples are expected for the range
+	closed func(start int64) bool
+	// onFlush is called after each block is flushed
+	onFlush func(p *writerPool, id ulid.ULID, stats *blockStats) error
+}
+
+func newWriterPool(ctx context.Context, dir, outputDir, tmpDir string, blockDuration int64, maxOpen int,
+	maxSamples int64, newWriter func(dir string) (blockWriter, error)) *writerPool {
+	return &writerPool{
+		ctx:           ctx,
+		dir:           dir,
+		outputDir:     outputDir,
+		tmpDir:        tmpDir,
+		blockDuration: blockDuration,
+		maxOpen:       maxOpen,
+		maxSamples:    maxSamples,
+		newWriter:     newWriter,
+		prepare: func(samples []auxStoreStruct) []auxStoreStruct {
+			return samples
+		},
+		onAppendError: func(*auxStoreStruct, error) {},
+		closed: func(int64) bool {
+			return false
+		},
+		ranges: make(map[int64]*rangeBuffer),
+		lru:    list.New(),
+	}
+}
+
+// blockRange returns the start of the block range including t. Block ranges are aligned to multiples of the
+// blockDuration (as Prometheus compaction does), so their boundaries don't depend on the arrival order of the samples
+// and blocks of different ranges never overlap.
+func (p *writerPool) blockRange(t int64) int64 {
+	return alignedStart(t, p.blockDuration)
+}
+
+// alignedStart returns the start of the range of size d, aligned to multiples of d, including t
+func alignedStart(t, d int64) int64 {
+	start := t - t%d
+	if t < 0 && t%d != 0 {
+		start -= d
+	}
+	return start
+}
+
+// add buffers the sample in its block range
+func (p *writerPool) add(m *auxStoreStruct) error {
+	start := p.blockRange(*m.metric.TimestampMs)
+	rb, ok := p.ranges[start]
+	if !ok {
+		rb = &rangeBuffer{start: start}
+		p.ranges[start] = rb
+	}
+	if rb.elem != nil {
+		p.lru.MoveToFront(rb.elem)
+	} else {
+		if p.lru.Len() >= p.maxOpen {
+			lru := p.lru.Back().Value.(*rangeBuffer)
+			Notice3("Too many open block ranges, evicting the least recently used one",
+				timestamp.Time(lru.start).String(), "-", timestamp.Time(lru.start+p.blockDuration).String())
+			if err := p.evict(lru); err != nil {
+				return err
+			}
+		}
+		rb.elem = p.lru.PushFront(rb)
+	}
+	rb.samples = append(rb.samples, *m)
+	p.samples++
+	if p.samples >= p.maxSamples {
+		Notice("Evicting the samples in memory (writes on Disk)...")
+		return p.evict(p.lru.Back().Value.(*rangeBuffer))
+	}
+	return nil
+}
+
+// evict releases the samples in memory of the range: they are flushed to the block if the range is closed, spilled
+// otherwise
+func (p *writerPool) evict(rb *rangeBuffer) error {
+	if p.closed(rb.start) {
+		return p.flush(rb)
+	}
+	return p.spill(rb)
+}
+
+// flushClosed flushes the closed ranges. It returns the first error, after trying to flush all of them
+func (p *writerPool) flushClosed() error {
+	var err error
+	for _, start := range p.starts() {
+		if p.closed(start) {
+			if ferr := p.flush(p.ranges[start]); err == nil {
+				err = ferr
+			}
+		}
+	}
+	return err
+}
+
+// flushBefore flushes the ranges ending at or before t. It returns the first error, after trying to flush all of them
+func (p *writerPool) flushBefore(t int64) error {
+	var err error
+	for _, start := range p.starts() {
+		if start+p.blockDuration > t {
+			break
+		}
+		if ferr := p.flush(p.ranges[start]); err == nil {
+			err = ferr
+		}
+	}
+	return err
+}
+
+// spill writes the samples in memory of the range to a new run file, sorted by time
+func (p *writerPool) spill(rb *rangeBuffer) error {
+	if p.spillDir == "" {
+		dir, err := ioutil.TempDir(p.tmpDir, "backfill-ranges-")
+		if err != nil {
+			return &FlushError{Dir: p.dir, Err: fmt.Errorf("unable to create the spill directory: %w", err)}
+		}
+		p.spillDir = dir
+	}
+	sortByTime(rb.samples)
+	path, err := writeRun(p.spillDir, rb.samples)
+	if err != nil {
+		return &FlushError{Dir: p.dir, Err: err}
+	}
+	rb.runs = append(rb.runs, path)
+	p.release(rb)
+	return nil
+}
+
+// release drops the samples in memory of the range
+func (p *writerPool) release(rb *rangeBuffer) {
+	if rb.elem != nil {
+		p.lru.Remove(rb.elem)
+		rb.elem = nil
+	}
+	p.samples -= int64(len(rb.samples))
+	rb.samples = nil
+}
+
+// flush appends the samples of the range to a new block in time order (the ones with the same timestamp in arrival
+// order, resolved by prepare) and removes the range from the pool. Blocks discarded by onFlush are not errors of the
+// flush
+func (p *writerPool) flush(rb *rangeBuffer) error {
+	delete(p.ranges, rb.start)
+	samples := rb.samples
+	p.release(rb)
+	sortByTime(samples)
+	runs := rb.runs
+	if len(runs) > 0 && len(samples) > 0 {
+		path, err := writeRun(p.spillDir, samples)
+		if err != nil {
+			removeRuns(runs)
+			return &FlushError{Dir: p.dir, Err: err}
+		}
+		runs = append(runs, path)
+	}
+	w, err := p.newWriter(p.dir)
+	if err != nil {
+		removeRuns(runs)
+		return &FlushError{Dir: p.dir, Err: err}
+	}
+	app := w.Appender(p.ctx)
+	stats := &blockStats{}
+	series := make(map[uint64]struct{})
+	var group []auxStoreStruct // Samples with the same timestamp
+	appendGroup := func() {
+		for _, m := range p.prepare(group) {
+			t, v := *m.metric.TimestampMs, sampleValue(m.metric)
+			if _, err := app.Add(m.labels, t, v); err != nil {
+				p.onAppendError(&m, err)
+				continue
+			}
+			series[labels2.Labels(m.labels).Hash()] = struct{}{}
+			if stats.samples == 0 {
+				stats.mint = t
+			}
+			stats.maxt = t
+			stats.samples++
+		}
+		group = group[:0]
+	}
+	visit := func(m *auxStoreStruct) error {
+		if len(group) > 0 && *group[0].metric.TimestampMs != *m.metric.TimestampMs {
+			appendGroup()
+		}
+		group = append(group, *m)
+		return nil
+	}
+	if len(runs) == 0 {
+		for i := range samples {
+			_ = visit(&samples[i])
+		}
+	} else {
+		Notice3("Merging", len(runs), "spilled runs of the block range",
+			timestamp.Time(rb.start).String(), "-", timestamp.Time(rb.start+p.blockDuration).String())
+		if runs, err = reduceRuns(p.spillDir, runs); err == nil {
+			err = mergeRuns(runs, visit)
+		}
+		if err != nil {
+			removeRuns(runs)
+			_ = w.Close()
+			return &FlushError{Dir: p.dir, Err: fmt.Errorf("unable to merge the run files: %w", err)}
+		}
+	}
+	appendGroup()
+	stats.series = len(series)
+	if stats.samples == 0 {
+		_ = app.Rollback()
+		return w.Close()
+	}
+	if err := app.Commit(); err != nil {
+		_ = w.Close()
+		return &FlushError{Dir: p.dir, Err: err}
+	}
+	id, err := w.Flush(p.ctx)
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return &FlushError{Dir: p.dir, Block: id, Err: err}
+	}
+	Notice3("Block written, flushed (new appender)", id.String())
+	if p.onFlush != nil && p.onFlush(p, id, stats) != nil {
+		return nil // The block has been discarded
+	}
+	p.flushed = append(p.flushed, id)
+	return nil
+}
+
+// flushAll flushes all the ranges. It returns the first error, after trying to flush all of them
+func (p *writerPool) flushAll() error {
+	var err error
+	for _, start := range p.starts() {
+		if ferr := p.flush(p.ranges[start]); err == nil {
+			err = ferr
+		}
+	}
+	return err
+}
+
+// starts returns the starts of the ranges of the pool, sorted
+func (p *writerPool) starts() []int64 {
+	starts := make([]int64, 0, len(p.ranges))
+	for start := range p.ranges {
+		starts = append(starts, start)
+	}
+	sort.Slice(starts, func(i, j int) bool { return starts[i] < starts[j] })
+	return starts
+}
+
+// close removes the spill directory of the pool
+func (p *writerPool) close() {
+	if p.spillDir != "" {
+		if err := os.RemoveAll(p.spillDir); err != nil {
+			ErrLog("Error removing the spill directory %s: %v\n", p.spillDir, err)
+		}
+		p.spillDir = ""
+	}
+}
+
+// sortByTime sorts the samples by time, keeping the arrival order of the ones with the same timestamp
+func sortByTime(samples []auxStoreStruct) {
+	sort.SliceStable(samples, func(i, j int) bool {
+		return *samples[i].metric.TimestampMs < *samples[j].metric.TimestampMs
+	})
+}
+
+// removeRuns deletes the run files
+func removeRuns(runs []string) {
+	for _, path := range runs {
+		_ = os.Remove(path)
+	}
+}
@@ -0,0 +1,199 @@
+package prometheus_backfill
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-kit/kit/log"
+	io_prometheus_client "github.com/prometheus/client_model/go"
+	labels2 "github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/tsdb"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+// testBlock is a block written by a test job
+type testBlock struct {
+	meta   tsdb.BlockMeta
+	series map[string][]testSample // Labels => samples
+}
+
+type testSample struct {
+	t int64
+	v float64
+}
+
+// runTestJob runs a job sending the tables to the handler. It returns the error of RunJob
+func runTestJob(t *testing.T, opts Options, tables ...interface{}) (*Handler, error) {
+	t.Helper()
+	ch := make(chan interface{})
+	bh, err := New(ch, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for _, table := range tables {
+			ch <- table
+		}
+		close(ch)
+	}()
+	return bh, bh.RunJob(context.Background())
+}
+
+// readTestBlocks reads the blocks of dir, sorted by min time
+func readTestBlocks(t *testing.T, dir string) []testBlock {
+	t.Helper()
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var blocks []testBlock
+	for _, e := range entries {
+		if _, err := os.Stat(filepath.Join(dir, e.Name(), "meta.json")); err != nil {
+			continue
+		}
+		b, err := tsdb.OpenBlock(log.NewNopLogger(), filepath.Join(dir, e.Name()), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		blocks = append(blocks, testBlock{meta: b.Meta(), series: readTestSeries(t, b)})
+		if err := b.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sort.Slice(blocks, func(i, j int) bool { return blocks[i].meta.MinTime < blocks[j].meta.MinTime })
+	return blocks
+}
+
+func readTestSeries(t *testing.T, b *tsdb.Block) map[string][]testSample {
+	t.Helper()
+	q, err := tsdb.NewBlockQuerier(b, math.MinInt64, math.MaxInt64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	series := make(map[string][]testSample)
+	ss := q.Select(false, nil, labels2.MustNewMatcher(labels2.MatchRegexp, labels2.MetricName, ".+"))
+	for ss.Next() {
+		it := ss.At().Iterator()
+		var samples []testSample
+		for it.Next() {
+			ts, v := it.At()
+			samples = append(samples, testSample{t: ts, v: v})
+		}
+		series[ss.At().Labels().String()] = samples
+	}
+	if err := ss.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return series
+}
+
+// checkNoOverlaps fails the test if blocks overlap
+func checkNoOverlaps(t *testing.T, blocks []testBlock) {
+	t.Helper()
+	for i := 1; i < len(blocks); i++ {
+		if blocks[i].meta.MinTime < blocks[i-1].meta.MaxTime {
+			t.Errorf("block [%d, %d) overlaps block [%d, %d)", blocks[i].meta.MinTime, blocks[i].meta.MaxTime,
+				blocks[i-1].meta.MinTime, blocks[i-1].meta.MaxTime)
+		}
+	}
+}
+
+func gauge(name string, t int64, v float64, labels ...string) Sample {
+	s := Sample{Labels: map[string]string{"__name__": name}, Timestamp: t, Value: v}
+	for i := 0; i+1 < len(labels); i += 2 {
+		s.Labels[labels[i]] = labels[i+1]
+	}
+	return s
+}
+
+func TestUnorderedInputDoesNotOverlap(t *testing.T) {
+	const ranges, perRange = 5, 40
+	hour := int64(time.Hour / time.Millisecond)
+	var tables []interface{}
+	for i := ranges*perRange - 1; i >= 0; i-- { // Reverse order, a sample per table
+		ts := int64(i) * hour / perRange
+		tables = append(tables, []Sample{gauge("m", ts, float64(i), "id", "a"), gauge("m", ts, float64(i), "id", "b")})
+	}
+	// Random jumps across the ranges too
+	for i := 0; i < ranges*perRange; i++ {
+		ts := int64((i*37)%(ranges*perRange))*hour/perRange + 1
+		tables = append(tables, []Sample{gauge("m", ts, 1, "id", "c")})
+	}
+	for _, streaming := range []bool{false, true} {
+		t.Run(fmt.Sprintf("streaming=%t", streaming), func(t *testing.T) {
+			dir := t.TempDir()
+			_, err := runTestJob(t, Options{
+				OutputDir:             dir,
+				BlockDuration:         time.Hour,
+				StoreThreshold:        2,
+				MaxSamplesPerAppender: 16,
+				MaxOpenBlockWriters:   2,
+				StreamingBlockWriter:  streaming,
+				VerifyBlocks:          true,
+			}, tables...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			blocks := readTestBlocks(t, dir)
+			if len(blocks) != ranges {
+				t.Fatalf("%d blocks, expected %d", len(blocks), ranges)
+			}
+			checkNoOverlaps(t, blocks)
+			for _, b := range blocks {
+				for _, id := range []string{"a", "b", "c"} {
+					samples := b.series[fmt.Sprintf(`{__name__="m", id="%s"}`, id)]
+					if len(samples) != perRange {
+						t.Errorf("block [%d, %d): %d samples of %s, expected %d", b.meta.MinTime, b.meta.MaxTime,
+							len(samples), id, perRange)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestWriterPoolFlushesClosedRanges(t *testing.T) {
+	dir := t.TempDir()
+	p := newWriterPool(context.Background(), dir, dir, t.TempDir(), 1000, 1, 1e6, func(dir string) (blockWriter, error) {
+		return tsdb.NewBlockWriter(log.NewNopLogger(), dir, 2000)
+	})
+	var watermark int64
+	p.closed = func(start int64) bool { return start+1000 <= watermark }
+	add := func(ts int64) {
+		v := float64(ts)
+		m := auxStoreStruct{metric: &io_prometheus_client.Metric{TimestampMs: &ts,
+			Gauge: &io_prometheus_client.Gauge{Value: &v}}, labels: labels2.FromStrings("__name__", "m")}
+		if err := p.add(&m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	add(1500)
+	add(500) // Evicts the range [1000, 2000), still open
+	if len(p.flushed) != 0 || p.spillDir == "" {
+		t.Fatalf("%d blocks flushed, spill directory %q: the open range should be spilled", len(p.flushed), p.spillDir)
+	}
+	watermark = 1000
+	add(1600) // Evicts the range [0, 1000), closed
+	if len(p.flushed) != 1 {
+		t.Fatalf("%d blocks flushed, expected the closed range", len(p.flushed))
+	}
+	watermark = 2000
+	if err := p.flushClosed(); err != nil {
+		t.Fatal(err)
+	}
+	p.close()
+	blocks := readTestBlocks(t, dir)
+	if len(blocks) != 2 {
+		t.Fatalf("%d blocks, expected 2", len(blocks))
+	}
+	checkNoOverlaps(t, blocks)
+	if samples := blocks[1].series[`{__name__="m"}`]; len(samples) != 2 || samples[0].t != 1500 || samples[1].t != 1600 {
+		t.Errorf("samples of the range [1000, 2000): %v", samples)
+	}
+}